@@ -0,0 +1,279 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+
+	cfClient "github.com/wdxxs2z/nginx-flow-osb/client"
+)
+
+//the state of a service instance whose nginx application is gone
+const appMissing = "MISSING"
+
+// AdminInstance is a stored service instance with the state of its nginx application
+type AdminInstance struct {
+	InstanceId      string                          `json:"instance_id"`
+	PlanId          string                          `json:"plan_id"`
+	SpaceGuid       string                          `json:"space_guid"`
+	AppGuid         string                          `json:"app_guid,omitempty"`
+	State           string                          `json:"state"`
+	PackageState    string                          `json:"package_state,omitempty"`
+	Instances       int                             `json:"instances,omitempty"`
+	StackGuid       string                          `json:"stack_guid,omitempty"`
+	Buildpack       string                          `json:"buildpack,omitempty"`
+	Bindings        int                             `json:"bindings"`
+	LastDeployment  *DeploymentResponse             `json:"last_deployment,omitempty"`
+	Stale           bool                            `json:"stale"`
+}
+
+// PurgeResponse lists the service instances whose nginx application is gone and counts the deleted records
+type PurgeResponse struct {
+	Instances         []string                      `json:"instances"`
+	BindingOperations int64                         `json:"binding_operations"`
+	Deployments       int64                         `json:"deployments"`
+	Revisions         int64                         `json:"revisions"`
+}
+
+// AdminInstances lists only the service instances deployed from another template when staleOnly
+func (nsb *NginxDataflowServiceBroker) AdminInstances(staleOnly bool) ([]AdminInstance, error) {
+	nsb.logger.Debug("admin-list-service-instances", lager.Data{
+		"stale_only":	staleOnly,
+	})
+	instanceIds, err := nsb.databaseClient.ListServiceInstanceIds()
+	if err != nil {
+		return nil, err
+	}
+	templateChecksum, err := nsb.templateChecksum()
+	if err != nil {
+		return nil, err
+	}
+	appNames := make([]string, 0)
+	for _, instanceID := range instanceIds {
+		appNames = append(appNames, "nginx-flow-" + instanceID)
+	}
+	apps, err := cfClient.GetApplicationsWorkflow(appNames, nsb.logger)
+	if err != nil {
+		return nil, err
+	}
+	instances := make([]AdminInstance, 0)
+	for _, instanceID := range instanceIds {
+		instance := AdminInstance{InstanceId: instanceID, State: appMissing}
+		if instance.PlanId, err = nsb.databaseClient.GetPlanWithServiceId(instanceID); err != nil {
+			return nil, err
+		}
+		if instance.SpaceGuid, err = nsb.databaseClient.GetSpaceWithServiceId(instanceID); err != nil {
+			return nil, err
+		}
+		ns, err := nsb.databaseClient.GetServiceInstance(instanceID)
+		if err != nil {
+			return nil, err
+		}
+		instance.Bindings = len(ns.Nginxs)
+		if app, ok := apps["nginx-flow-" + instanceID]; ok {
+			instance.AppGuid = app.Guid
+			instance.State = app.State
+			instance.PackageState = app.PackageState
+			instance.Instances = app.Instances
+			instance.StackGuid = app.StackGuid
+			instance.Buildpack = app.Buildpack
+		}
+		deployments, err := nsb.databaseClient.ListDeployments(instanceID, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(deployments) > 0 {
+			lastDeployment := deploymentResponse(deployments[0])
+			instance.LastDeployment = &lastDeployment
+		}
+		instance.Stale = staleDeployment(deployments, templateChecksum)
+		if staleOnly && !instance.Stale {
+			continue
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// PurgeOrphans forgets the service instances whose nginx application is gone, as a deprovision would
+func (nsb *NginxDataflowServiceBroker) PurgeOrphans() (PurgeResponse, error) {
+	nsb.logger.Debug("admin-purge-orphans", lager.Data{})
+	if err := nsb.checkReconciler(); err != nil {
+		return PurgeResponse{}, err
+	}
+	instanceIds, err := nsb.databaseClient.ListServiceInstanceIds()
+	if err != nil {
+		return PurgeResponse{}, err
+	}
+	purged := PurgeResponse{Instances: make([]string, 0)}
+	for _, instanceID := range instanceIds {
+		orphan, err := nsb.purgeOrphanInstance(instanceID)
+		if err != nil {
+			return purged, err
+		}
+		if orphan {
+			purged.Instances = append(purged.Instances, instanceID)
+		}
+	}
+	if purged.BindingOperations, err = nsb.databaseClient.DeleteOrphanBindingOperations(); err != nil {
+		return purged, err
+	}
+	if purged.Deployments, err = nsb.databaseClient.DeleteOrphanDeployments(); err != nil {
+		return purged, err
+	}
+	if purged.Revisions, err = nsb.databaseClient.DeleteOrphanRevisions(); err != nil {
+		return purged, err
+	}
+	return purged, nil
+}
+
+//the lock waits for a deploy in progress, a migration renames the blue application at its end
+func (nsb *NginxDataflowServiceBroker) purgeOrphanInstance(instanceID string) (bool, error) {
+	unlock := nsb.lockInstance(instanceID)
+	defer unlock()
+	appExist, err := cfClient.CheckApplicationExistWorkflow("nginx-flow-" + instanceID, nsb.logger)
+	if err != nil || appExist {
+		return false, err
+	}
+	if err := nsb.databaseClient.DeleteServiceInstance(instanceID); err != nil {
+		return false, err
+	}
+	nsb.statsMutex.Lock()
+	delete(nsb.statsCounters, instanceID)
+	nsb.statsMutex.Unlock()
+	return true, nil
+}
+
+func (nsb *NginxDataflowServiceBroker) adminInstancesHandler(w http.ResponseWriter, r *http.Request) {
+	instances, err := nsb.AdminInstances(r.URL.Query().Get("stale") == "true")
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	respond(w, http.StatusOK, instances)
+}
+
+func (nsb *NginxDataflowServiceBroker) adminRedeployHandler(w http.ResponseWriter, r *http.Request) {
+	if err := nsb.redeploy(mux.Vars(r)["instance_id"], deployRedeploy); err != nil {
+		respondError(w, err)
+		return
+	}
+	respond(w, http.StatusOK, brokerapi.EmptyResponse{})
+}
+
+func (nsb *NginxDataflowServiceBroker) adminPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	purged, err := nsb.PurgeOrphans()
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	respond(w, http.StatusOK, purged)
+}
+
+var ErrReconcilerPaused = brokerapi.NewFailureResponseBuilder(
+	errors.New("the reconciler is paused, resume it first"), http.StatusConflict, "reconciler-paused",
+).Build()
+
+//the broker state key of the reconciler
+const reconcilerStateKey = "reconciler"
+
+const reconcilerPausedReason = "the reconciler is paused"
+
+// Reconciler pauses the deploys the platform did not ask for, a paused rollout is held and the others are refused
+type Reconciler struct {
+	Paused          bool                            `json:"paused"`
+	PausedAt        *time.Time                      `json:"paused_at,omitempty"`
+}
+
+func (nsb *NginxDataflowServiceBroker) ReconcilerState() (Reconciler, error) {
+	nsb.rolloutMutex.Lock()
+	defer nsb.rolloutMutex.Unlock()
+	return nsb.reconciler, nil
+}
+
+func (nsb *NginxDataflowServiceBroker) PauseReconciler() (Reconciler, error) {
+	nsb.logger.Debug("admin-pause-reconciler", lager.Data{})
+	nsb.rolloutMutex.Lock()
+	defer nsb.rolloutMutex.Unlock()
+	if nsb.reconciler.Paused {
+		return nsb.reconciler, nil
+	}
+	paused := time.Now()
+	reconciler := Reconciler{Paused: true, PausedAt: &paused}
+	if err := nsb.saveReconciler(reconciler); err != nil {
+		return Reconciler{}, err
+	}
+	nsb.reconciler = reconciler
+	if rollout := nsb.rollout; rollout != nil && rollout.FinishedAt == nil && rollout.State == rolloutRunning {
+		rollout.State = rolloutPaused
+		rollout.Reason = reconcilerPausedReason
+		nsb.saveRollout(rollout)
+		rollout.signal()
+	}
+	return nsb.reconciler, nil
+}
+
+// ResumeReconciler resumes the rollout the pause held, a rollout paused for another reason stays paused
+func (nsb *NginxDataflowServiceBroker) ResumeReconciler() (Reconciler, error) {
+	nsb.logger.Debug("admin-resume-reconciler", lager.Data{})
+	nsb.rolloutMutex.Lock()
+	defer nsb.rolloutMutex.Unlock()
+	if !nsb.reconciler.Paused {
+		return nsb.reconciler, nil
+	}
+	if err := nsb.saveReconciler(Reconciler{}); err != nil {
+		return Reconciler{}, err
+	}
+	nsb.reconciler = Reconciler{}
+	if rollout := nsb.rollout; rollout != nil && rollout.FinishedAt == nil && rollout.State == rolloutPaused && rollout.Reason == reconcilerPausedReason {
+		rollout.State = rolloutRunning
+		rollout.Reason = ""
+		nsb.saveRollout(rollout)
+		rollout.signal()
+	}
+	return nsb.reconciler, nil
+}
+
+func (nsb *NginxDataflowServiceBroker) checkReconciler() error {
+	nsb.rolloutMutex.Lock()
+	defer nsb.rolloutMutex.Unlock()
+	if nsb.reconciler.Paused {
+		return ErrReconcilerPaused
+	}
+	return nil
+}
+
+func (nsb *NginxDataflowServiceBroker) saveReconciler(reconciler Reconciler) error {
+	details, err := json.Marshal(reconciler)
+	if err != nil {
+		return err
+	}
+	return nsb.databaseClient.SaveBrokerState(reconcilerStateKey, details)
+}
+
+// restoreReconciler keeps the reconciler paused across the restarts of the broker
+func (nsb *NginxDataflowServiceBroker) restoreReconciler() error {
+	details, err := nsb.databaseClient.GetBrokerState(reconcilerStateKey)
+	if err != nil || details == nil {
+		return err
+	}
+	nsb.rolloutMutex.Lock()
+	defer nsb.rolloutMutex.Unlock()
+	return json.Unmarshal(details, &nsb.reconciler)
+}
+
+func (nsb *NginxDataflowServiceBroker) reconcilerHandler(change func() (Reconciler, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reconciler, err := change()
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		respond(w, http.StatusOK, reconciler)
+	}
+}
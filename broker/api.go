@@ -0,0 +1,440 @@
+package broker
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"net/http"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/gorilla/mux"
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/wdxxs2z/nginx-flow-osb/db"
+	"github.com/wdxxs2z/nginx-flow-osb/route"
+)
+
+// the handlers below fill the OSB 2.14 gaps of the vendored brokerapi
+type CatalogService struct {
+	brokerapi.Service
+	InstancesRetrievable	bool				`json:"instances_retrievable"`
+	BindingsRetrievable	bool				`json:"bindings_retrievable"`
+}
+
+type CatalogResponse struct {
+	Services		[]CatalogService		`json:"services"`
+}
+
+type ServiceInstanceResponse struct {
+	ServiceID		string				`json:"service_id,omitempty"`
+	PlanID			string				`json:"plan_id,omitempty"`
+	DashboardURL		string				`json:"dashboard_url,omitempty"`
+	Parameters		route.NginxService		`json:"parameters"`
+}
+
+type AsyncBindingResponse struct {
+	OperationData		string				`json:"operation,omitempty"`
+}
+
+const bindOperation = "bind"
+
+//an operation still in progress past it lost its deploy
+const bindingOperationTimeout = 30 * time.Minute
+
+const staleBindingOperation = "the deploy of the nginx application did not finish"
+
+var ErrBindingInProgress = brokerapi.NewFailureResponseBuilder(
+	errors.New("the binding is still being created, retry when its last operation finished"), http.StatusUnprocessableEntity, "binding-in-progress",
+).WithErrorKey("ConcurrencyError").Build()
+
+type ServiceBindingResponse struct {
+	Credentials		interface{}			`json:"credentials"`
+	SyslogDrainURL		string				`json:"syslog_drain_url,omitempty"`
+	RouteServiceURL		string				`json:"route_service_url,omitempty"`
+}
+
+func (nsb *NginxDataflowServiceBroker)GetInstance(instanceID string) (ServiceInstanceResponse, error) {
+	nsb.logger.Debug("fetch-service-instance", lager.Data{
+		"instance_id":        	instanceID,
+	})
+	exist, err := nsb.databaseClient.ExistServiceInstance(instanceID)
+	if err != nil {
+		return ServiceInstanceResponse{}, err
+	}
+	if exist == false {
+		return ServiceInstanceResponse{}, brokerapi.ErrInstanceDoesNotExist
+	}
+	ns, err := nsb.databaseClient.GetServiceInstance(instanceID)
+	if err != nil {
+		return ServiceInstanceResponse{}, err
+	}
+	planId, err := nsb.databaseClient.GetPlanWithServiceId(instanceID)
+	if err != nil {
+		return ServiceInstanceResponse{}, err
+	}
+	service, plan := nsb.GetPlanWithId(planId)
+	//the password hashes, the status path and the fetched error pages stay in the broker
+	for i := range ns.Access.BasicAuth {
+		ns.Access.BasicAuth[i].Hash = ""
+	}
+	for status, page := range ns.ErrorPages {
+		if page.Url != "" {
+			page.Html = ""
+			ns.ErrorPages[status] = page
+		}
+	}
+	ns.StatusPath = ""
+	return ServiceInstanceResponse{
+		ServiceID:	service.Id,
+		PlanID:		plan.Id,
+		DashboardURL:	nsb.dashboardURL(service, instanceID),
+		Parameters:     ns,
+	}, nil
+}
+
+func (nsb *NginxDataflowServiceBroker)GetBinding(instanceID, bindingID string) (ServiceBindingResponse, error) {
+	nsb.logger.Debug("fetch-service-binding", lager.Data{
+		"instance_id":        	instanceID,
+		"binding_id":		bindingID,
+	})
+	ns, err := nsb.databaseClient.GetServiceInstance(instanceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ServiceBindingResponse{}, brokerapi.ErrBindingDoesNotExist
+		}
+		return ServiceBindingResponse{}, err
+	}
+	planId, err := nsb.databaseClient.GetPlanWithServiceId(instanceID)
+	if err != nil {
+		return ServiceBindingResponse{}, err
+	}
+	service, _ := nsb.GetPlanWithId(planId)
+	for _, n := range ns.Nginxs {
+		if n.Name == bindingID {
+			return ServiceBindingResponse{
+				Credentials:	bindingCredentials(ns),
+				SyslogDrainURL:	nsb.bindingSyslogDrain(service.Id, ns),
+			}, nil
+		}
+	}
+	return ServiceBindingResponse{}, brokerapi.ErrBindingDoesNotExist
+}
+
+// BindAsync returns at once, the redeploy runs in the background and is polled with LastBindingOperation
+func (nsb *NginxDataflowServiceBroker)BindAsync(instanceID, bindingID string, details brokerapi.BindDetails) (string, bool, error) {
+	nsb.logger.Debug("bind-async", lager.Data{
+		"instance_id":        	instanceID,
+		"binding_id":		bindingID,
+	})
+	operation, err := nsb.bindingOperation(bindingID)
+	if err != nil {
+		return "", false, err
+	}
+	if brokerapi.LastOperationState(operation.State) == brokerapi.InProgress {
+		return bindOperation, false, nil
+	}
+	bound, err := nsb.boundNginx(instanceID, bindingID)
+	if err != nil {
+		return "", false, err
+	}
+	if bound != nil {
+		if !nsb.sameBinding(*bound, instanceID, bindingID, details) {
+			return "", false, brokerapi.ErrBindingAlreadyExists
+		}
+		return "", true, nil
+	}
+	bindNginx, err := nsb.newBindingNginx(instanceID, bindingID, details)
+	if err != nil {
+		return "", false, err
+	}
+	if operation.State != "" {
+		if err := nsb.databaseClient.DeleteBindingOperation(bindingID); err != nil {
+			return "", false, err
+		}
+	}
+	err = nsb.databaseClient.CreateBindingOperation(db.BindingOperation{
+		BindingId:		bindingID,
+		ServiceInstanceId:	instanceID,
+		State:			string(brokerapi.InProgress),
+		Description:		"deploying the nginx application",
+		StartedAt:		time.Now(),
+	})
+	if err != nil {
+		return "", false, err
+	}
+	go func() {
+		state, description := brokerapi.Succeeded, "the nginx application is deployed"
+		if _, err := nsb.attachBinding(instanceID, details.PlanID, bindNginx); err != nil {
+			nsb.logger.Error("bind-async-failed", err, lager.Data{
+				"instance_id":	instanceID,
+				"binding_id":	bindingID,
+			})
+			state, description = brokerapi.Failed, err.Error()
+		}
+		if err := nsb.databaseClient.UpdateBindingOperation(bindingID, string(state), description); err != nil {
+			nsb.logger.Error("update-binding-operation-failed", err, lager.Data{
+				"binding_id":	bindingID,
+			})
+		}
+	}()
+	return bindOperation, false, nil
+}
+
+// boundNginx returns nil when the binding is not attached
+func (nsb *NginxDataflowServiceBroker)boundNginx(instanceID, bindingID string) (*route.Nginx, error) {
+	exist, err := nsb.databaseClient.ExistServiceInstance(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if exist == false {
+		return nil, brokerapi.ErrInstanceDoesNotExist
+	}
+	ns, err := nsb.databaseClient.GetServiceInstance(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range ns.Nginxs {
+		if n.Name == bindingID {
+			return &n, nil
+		}
+	}
+	return nil, nil
+}
+
+// sameBinding skips the parameters the request leaves to the broker
+func (nsb *NginxDataflowServiceBroker)sameBinding(bound route.Nginx, instanceID, bindingID string, details brokerapi.BindDetails) bool {
+	if details.AppGUID != bound.AppGuid {
+		return false
+	}
+	requested := route.Nginx{}
+	if len(details.GetRawParameters()) > 0 {
+		bindParameters := BindParameters{}
+		if err := json.Unmarshal(details.RawParameters, &bindParameters); err != nil {
+			return false
+		}
+		var err error
+		if requested, err = nsb.ParseBindParameters(instanceID, bindingID, bindParameters); err != nil {
+			return false
+		}
+	}
+	if (requested.Url != "" && requested.Url != bound.Url) ||
+		(requested.Weight != 0 && !bound.Mirror() && requested.Weight != bound.Weight) ||
+		(requested.BackendPort != 0 && requested.BackendPort != bound.BackendPort) ||
+		(requested.Internal && !bound.Internal) {
+		return false
+	}
+	return requested.Protocol == bound.Protocol &&
+		requested.Role == bound.Role &&
+		requested.MirrorPercent == bound.MirrorPercent &&
+		sameJSON(requested.Headers, bound.Headers) &&
+		sameJSON(requested.Proxy, bound.Proxy)
+}
+
+//the stored backends went through json, which drops the empty maps
+func sameJSON(a, b interface{}) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && string(aJSON) == string(bJSON)
+}
+
+// bindingOperation fails the operation in progress past bindingOperationTimeout
+func (nsb *NginxDataflowServiceBroker)bindingOperation(bindingID string) (db.BindingOperation, error) {
+	operation, err := nsb.databaseClient.GetBindingOperation(bindingID)
+	if err != nil {
+		return db.BindingOperation{}, err
+	}
+	if brokerapi.LastOperationState(operation.State) != brokerapi.InProgress || time.Since(operation.StartedAt) < bindingOperationTimeout {
+		return operation, nil
+	}
+	operation.State = string(brokerapi.Failed)
+	operation.Description = staleBindingOperation
+	if err := nsb.databaseClient.UpdateBindingOperation(bindingID, operation.State, operation.Description); err != nil {
+		return db.BindingOperation{}, err
+	}
+	return operation, nil
+}
+
+func (nsb *NginxDataflowServiceBroker)LastBindingOperation(instanceID, bindingID string) (brokerapi.LastOperation, error) {
+	nsb.logger.Debug("last-binding-operation", lager.Data{
+		"instance_id":        	instanceID,
+		"binding_id":		bindingID,
+	})
+	operation, err := nsb.bindingOperation(bindingID)
+	if err != nil {
+		return brokerapi.LastOperation{}, err
+	}
+	if operation.State != "" {
+		return brokerapi.LastOperation{
+			State:		brokerapi.LastOperationState(operation.State),
+			Description:    operation.Description,
+		}, nil
+	}
+	//synchronous binds leave no operation behind
+	if _, err := nsb.GetBinding(instanceID, bindingID); err != nil {
+		return brokerapi.LastOperation{}, err
+	}
+	return brokerapi.LastOperation{
+		State:		brokerapi.Succeeded,
+		Description:    "the nginx application is deployed",
+	}, nil
+}
+
+func (nsb *NginxDataflowServiceBroker)catalogHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkBrokerAPIVersion(r); err != nil {
+		respond(w, http.StatusPreconditionFailed, brokerapi.ErrorResponse{Description: err.Error()})
+		return
+	}
+	services, err := nsb.Services(r.Context())
+	if err != nil {
+		respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{Description: err.Error()})
+		return
+	}
+	catalog := CatalogResponse{
+		Services:	make([]CatalogService, 0),
+	}
+	for _, service := range services {
+		catalog.Services = append(catalog.Services, CatalogService{
+			Service:		service,
+			InstancesRetrievable:   true,
+			BindingsRetrievable:    true,
+		})
+	}
+	respond(w, http.StatusOK, catalog)
+}
+
+func (nsb *NginxDataflowServiceBroker)getInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkBrokerAPIVersion(r); err != nil {
+		respond(w, http.StatusPreconditionFailed, brokerapi.ErrorResponse{Description: err.Error()})
+		return
+	}
+	instance, err := nsb.GetInstance(mux.Vars(r)["instance_id"])
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	respond(w, http.StatusOK, instance)
+}
+
+func (nsb *NginxDataflowServiceBroker)getBindingHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkBrokerAPIVersion(r); err != nil {
+		respond(w, http.StatusPreconditionFailed, brokerapi.ErrorResponse{Description: err.Error()})
+		return
+	}
+	vars := mux.Vars(r)
+	binding, err := nsb.GetBinding(vars["instance_id"], vars["binding_id"])
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	respond(w, http.StatusOK, binding)
+}
+
+func (nsb *NginxDataflowServiceBroker)asyncBindHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkBrokerAPIVersion(r); err != nil {
+		respond(w, http.StatusPreconditionFailed, brokerapi.ErrorResponse{Description: err.Error()})
+		return
+	}
+	var details brokerapi.BindDetails
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+		respond(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{Description: err.Error()})
+		return
+	}
+	if details.ServiceID == "" || details.PlanID == "" {
+		respond(w, http.StatusBadRequest, brokerapi.ErrorResponse{Description: "service_id and plan_id must not be blank"})
+		return
+	}
+	vars := mux.Vars(r)
+	operationData, bound, err := nsb.BindAsync(vars["instance_id"], vars["binding_id"], details)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	if bound {
+		binding, err := nsb.GetBinding(vars["instance_id"], vars["binding_id"])
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		respond(w, http.StatusOK, binding)
+		return
+	}
+	respond(w, http.StatusAccepted, AsyncBindingResponse{OperationData: operationData})
+}
+
+func (nsb *NginxDataflowServiceBroker)lastBindingOperationHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkBrokerAPIVersion(r); err != nil {
+		respond(w, http.StatusPreconditionFailed, brokerapi.ErrorResponse{Description: err.Error()})
+		return
+	}
+	vars := mux.Vars(r)
+	lastOperation, err := nsb.LastBindingOperation(vars["instance_id"], vars["binding_id"])
+	if err == brokerapi.ErrBindingDoesNotExist {
+		respond(w, http.StatusGone, brokerapi.EmptyResponse{})
+		return
+	}
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	respond(w, http.StatusOK, brokerapi.LastOperationResponse{
+		State:		lastOperation.State,
+		Description:    lastOperation.Description,
+	})
+}
+
+func bindingCredentials(ns route.NginxService) map[string]interface{} {
+	credentials := make(map[string]interface{})
+	credentials["host"] = ns.Host
+	credentials["domain"] = ns.Domain
+	credentials["nginxs"] = ns.Nginxs
+	if ns.TcpRoute != nil {
+		credentials["tcp_route"] = ns.TcpRoute
+	}
+	if mirrors := ns.MirrorNginxs(); len(mirrors) > 0 {
+		credentials["mirrors"] = mirrors
+	}
+	return credentials
+}
+
+// bindingSyslogDrain is only accepted by cloud foundry from services requiring syslog_drain
+func (nsb *NginxDataflowServiceBroker) bindingSyslogDrain(serviceID string, ns route.NginxService) string {
+	service, _ := nsb.GetService(serviceID)
+	for _, requirement := range service.Requires {
+		if requirement == "syslog_drain" {
+			return ns.SyslogDrainUrl
+		}
+	}
+	return ""
+}
+
+// fetch endpoints answer 404 rather than 410 for a missing resource
+func respondError(w http.ResponseWriter, err error) {
+	if err == brokerapi.ErrInstanceDoesNotExist || err == brokerapi.ErrBindingDoesNotExist {
+		respond(w, http.StatusNotFound, brokerapi.ErrorResponse{Description: err.Error()})
+		return
+	}
+	if failure, ok := err.(*brokerapi.FailureResponse); ok {
+		respond(w, failure.ValidatedStatusCode(nil), failure.ErrorResponse())
+		return
+	}
+	respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{Description: err.Error()})
+}
+
+func respond(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+func checkBrokerAPIVersion(r *http.Request) error {
+	apiVersion := r.Header.Get("X-Broker-API-Version")
+	if apiVersion == "" {
+		return errors.New("X-Broker-API-Version Header not set")
+	}
+	if !strings.HasPrefix(apiVersion, "2.") {
+		return errors.New("X-Broker-API-Version Header must be 2.x")
+	}
+	return nil
+}
@@ -5,8 +5,13 @@ import (
 	"log"
 	"fmt"
 	"context"
+	"sync"
+	"time"
 	"strings"
+	"reflect"
+	"regexp"
 	"net/http"
+	"io/ioutil"
 	"encoding/json"
 	_ "net/http/pprof"
 
@@ -36,6 +41,15 @@ type NginxDataflowServiceBroker struct {
 	brokerRouter			*mux.Router
 	databaseClient                  *db.DBClient
 	config                          config.Config
+	serviceSpaceGuid                string
+	instanceLocks                   map[string]*sync.Mutex
+	instanceLocksMutex              sync.Mutex
+	statsCounters                   map[string]*instanceCounters
+	statsMutex                      sync.Mutex
+	dashboards                      dashboards
+	rollout                         *Rollout
+	reconciler                      Reconciler
+	rolloutMutex                    sync.Mutex
 }
 
 func New(config config.Config, logger lager.Logger) *NginxDataflowServiceBroker{
@@ -49,6 +63,36 @@ func New(config config.Config, logger lager.Logger) *NginxDataflowServiceBroker{
 		logger.Error("Error-migrate-servicetable", err, lager.Data{})
 		return nil
 	}
+	if err := dbClient.MigrateBindingOperationTable(); err != nil {
+		logger.Error("Error-migrate-bindingoperationtable", err, lager.Data{})
+		return nil
+	}
+	//other broker instances may still deploy the recent ones
+	failed, err := dbClient.FailBindingOperations(string(brokerapi.InProgress), string(brokerapi.Failed), staleBindingOperation, time.Now().Add(-bindingOperationTimeout))
+	if err != nil {
+		logger.Error("Error-fail-bindingoperations", err, lager.Data{})
+		return nil
+	}
+	if failed > 0 {
+		logger.Info("failed-orphan-binding-operations", lager.Data{"operations": failed})
+	}
+	if err := dbClient.MigrateDeploymentTable(); err != nil {
+		logger.Error("Error-migrate-deploymenttable", err, lager.Data{})
+		return nil
+	}
+	if err := dbClient.MigrateRevisionTable(); err != nil {
+		logger.Error("Error-migrate-revisiontable", err, lager.Data{})
+		return nil
+	}
+	if err := dbClient.MigrateBrokerStateTable(); err != nil {
+		logger.Error("Error-migrate-brokerstatetable", err, lager.Data{})
+		return nil
+	}
+	serviceSpace, err := cfClient.EnsureServiceSpaceWorkflow(config.ServiceOrg, config.ServiceSpace, logger)
+	if err != nil {
+		logger.Error("Error-ensure-service-space", err, lager.Data{})
+		return nil
+	}
 	broker := &NginxDataflowServiceBroker{
 		allowUserBindParameters:	config.AllowUserBindParameters,
 		allowUserProvisionParameters:   config.AllowUserProvisionParameters,
@@ -57,11 +101,69 @@ func New(config config.Config, logger lager.Logger) *NginxDataflowServiceBroker{
 		brokerRouter:                   brokerRouter,
 		databaseClient:                 dbClient,
 		config:                         config,
+		serviceSpaceGuid:               serviceSpace.Guid,
+		instanceLocks:                  make(map[string]*sync.Mutex),
+		statsCounters:                  make(map[string]*instanceCounters),
+		dashboards:                     dashboards{
+			sessions:	make(map[string]*dashboardSession),
+			logins:		make(map[string]dashboardLogin),
+		},
+	}
+	broker.brokerRouter.HandleFunc("/v2/catalog", broker.catalogHandler).Methods(http.MethodGet)
+	broker.brokerRouter.HandleFunc("/v2/service_instances/{instance_id}", broker.getInstanceHandler).Methods(http.MethodGet)
+	broker.brokerRouter.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", broker.getBindingHandler).Methods(http.MethodGet)
+	broker.brokerRouter.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", broker.asyncBindHandler).Methods(http.MethodPut).Queries("accepts_incomplete", "true")
+	broker.brokerRouter.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}/last_operation", broker.lastBindingOperationHandler).Methods(http.MethodGet)
+	broker.brokerRouter.HandleFunc("/instances/{instance_id}/cache/purge", broker.purgeCacheHandler).Methods(http.MethodPost)
+	broker.brokerRouter.HandleFunc("/instances/{instance_id}/stats", broker.statsHandler).Methods(http.MethodGet)
+	//the dashboard signs the users in through uaa instead of the broker credentials
+	dashboardRoutes := []*mux.Route{
+		broker.brokerRouter.HandleFunc("/dashboard", broker.dashboardHandler).Methods(http.MethodGet),
+		broker.brokerRouter.HandleFunc("/dashboard/callback", broker.dashboardCallbackHandler).Methods(http.MethodGet),
+		broker.brokerRouter.HandleFunc("/dashboard/logout", broker.dashboardLogoutHandler).Methods(http.MethodGet),
+		broker.brokerRouter.HandleFunc("/dashboard/instances/{instance_id}", broker.dashboardInstanceHandler).Methods(http.MethodGet),
+		broker.brokerRouter.HandleFunc("/dashboard/instances/{instance_id}/weights", broker.dashboardWeightsHandler).Methods(http.MethodPost),
+		broker.brokerRouter.HandleFunc("/dashboard/instances/{instance_id}/redeploy", broker.dashboardRedeployHandler).Methods(http.MethodPost),
+	}
+	//the operators sign in with the admin credentials, not with the broker credentials of the platform
+	adminRoutes := []*mux.Route{
+		broker.brokerRouter.HandleFunc("/admin/instances", broker.adminInstancesHandler).Methods(http.MethodGet),
+		broker.brokerRouter.HandleFunc("/admin/instances/{instance_id}/redeploy", broker.adminRedeployHandler).Methods(http.MethodPost),
+		broker.brokerRouter.HandleFunc("/admin/instances/{instance_id}/deployments", broker.deploymentsHandler).Methods(http.MethodGet),
+		broker.brokerRouter.HandleFunc("/admin/instances/{instance_id}/revisions", broker.revisionsHandler).Methods(http.MethodGet),
+		broker.brokerRouter.HandleFunc("/admin/instances/{instance_id}/rollback", broker.rollbackHandler).Methods(http.MethodPost),
+		broker.brokerRouter.HandleFunc("/admin/orphans/purge", broker.adminPurgeHandler).Methods(http.MethodPost),
+		broker.brokerRouter.HandleFunc("/admin/reconciler", broker.reconcilerHandler(broker.ReconcilerState)).Methods(http.MethodGet),
+		broker.brokerRouter.HandleFunc("/admin/reconciler/pause", broker.reconcilerHandler(broker.PauseReconciler)).Methods(http.MethodPost),
+		broker.brokerRouter.HandleFunc("/admin/reconciler/resume", broker.reconcilerHandler(broker.ResumeReconciler)).Methods(http.MethodPost),
+		broker.brokerRouter.HandleFunc("/admin/rotation", broker.rolloutHandler(broker.LastRollout)).Methods(http.MethodGet),
+		broker.brokerRouter.HandleFunc("/admin/rotation", broker.startRotationHandler).Methods(http.MethodPost),
+		broker.brokerRouter.HandleFunc("/admin/rollout", broker.rolloutHandler(broker.LastRollout)).Methods(http.MethodGet),
+		broker.brokerRouter.HandleFunc("/admin/rollout", broker.startRolloutHandler).Methods(http.MethodPost),
+		broker.brokerRouter.HandleFunc("/admin/rollout/pause", broker.rolloutHandler(broker.PauseRollout)).Methods(http.MethodPost),
+		broker.brokerRouter.HandleFunc("/admin/rollout/resume", broker.rolloutHandler(broker.ResumeRollout)).Methods(http.MethodPost),
+		broker.brokerRouter.HandleFunc("/admin/rollout/cancel", broker.rolloutHandler(broker.CancelRollout)).Methods(http.MethodPost),
+	}
+	if err := broker.restoreReconciler(); err != nil {
+		logger.Error("Error-restore-reconciler", err, lager.Data{})
+		return nil
+	}
+	if err := broker.restoreRollout(); err != nil {
+		logger.Error("Error-restore-rollout", err, lager.Data{})
+		return nil
 	}
 	brokerapi.AttachRoutes(broker.brokerRouter, broker, logger)
 	liveness := broker.brokerRouter.HandleFunc("/liveness", livenessHandler).Methods(http.MethodGet)
 
-	broker.brokerRouter.Use(authHandler(map[*mux.Route]bool{liveness: true}))
+	noAuthRequired := map[*mux.Route]bool{liveness: true}
+	for _, dashboardRoute := range dashboardRoutes {
+		noAuthRequired[dashboardRoute] = true
+	}
+	adminAuthRequired := make(map[*mux.Route]bool)
+	for _, adminRoute := range adminRoutes {
+		adminAuthRequired[adminRoute] = true
+	}
+	broker.brokerRouter.Use(authHandler(noAuthRequired, adminAuthRequired))
 	broker.brokerRouter.Use(handlers.ProxyHeaders)
 	broker.brokerRouter.Use(handlers.CompressHandler)
 	broker.brokerRouter.Use(handlers.CORS(
@@ -86,7 +188,14 @@ func (nsb *NginxDataflowServiceBroker)Services(context context.Context) ([]broke
 	var services []brokerapi.Service
 
 	for _, nginxService := range nginxDataflowServices {
-
+		var dashboardClient *brokerapi.ServiceDashboardClient
+		if nginxService.DashboardClient["id"] != "" {
+			dashboardClient = &brokerapi.ServiceDashboardClient{
+				ID:		nginxService.DashboardClient["id"],
+				Secret:		nginxService.DashboardClient["secret"],
+				RedirectURI:	nginxService.DashboardClient["redirect_uri"],
+			}
+		}
 		services = append(services, brokerapi.Service{
 			ID:			nginxService.Id,
 			Name:           	nginxService.Name,
@@ -103,6 +212,7 @@ func (nsb *NginxDataflowServiceBroker)Services(context context.Context) ([]broke
 				SupportUrl:		nginxService.Metadata.SupportUrl,
 			},
 			Plans:          	servicePlans(nginxService.Plans),
+			DashboardClient:	dashboardClient,
 		})
 	}
 	return services,nil
@@ -143,40 +253,44 @@ func (nsb *NginxDataflowServiceBroker)Provision(context context.Context, instanc
 		if jsonErr := json.Unmarshal(details.RawParameters, &provisionParameters); jsonErr != nil {
 			return brokerapi.ProvisionedServiceSpec{}, jsonErr
 		}
-		ns , err := nsb.ParseParameters(instanceID, provisionParameters)
+		ns , err := nsb.ParseParameters(route.NginxService{ServiceId: instanceID}, provisionParameters)
+		if failure, ok := err.(*brokerapi.FailureResponse); ok {
+			return brokerapi.ProvisionedServiceSpec{}, failure
+		}
 		if err != nil {
 			return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("parse parameter error: %s", err)
 		}
+		if err := checkPlan(plan, ns); err != nil {
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
 		err = nsb.PreparePushDir(instanceID, ns)
 		if err != nil {
 			return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("prepare push director err: %s", err)
 		}
-		var spaceName string
+		spaceGuid := details.SpaceGUID
 		if plan.EnableSystemSpace {
-			spaceName = nsb.config.ServiceSpace
-		} else {
-			space, err := cfClient.GetSpaceWorkflow(details.SpaceGUID, nsb.logger)
-			if err != nil {
-				return brokerapi.ProvisionedServiceSpec{}, err
-			}
-			spaceName = space.Name
+			spaceGuid = nsb.serviceSpaceGuid
 		}
-		_, err = cfClient.CreateApplicationWorkflow("nginx-flow-" + instanceID, spaceName, ns.Host, ns.Domain, sourceDir, destinationDir,
-			plan.InstanceConfig.InstanceNum,
-			plan.InstanceConfig.Memory,
-			plan.InstanceConfig.Disk,
-			plan.InstanceConfig.Buildpack, nsb.logger)
+		if err := nsb.reserveTcpRoute(&ns, spaceGuid); err != nil {
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
+		app, err := cfClient.CreateApplicationWorkflow("nginx-flow-" + instanceID, spaceGuid, sourceDir, destinationDir, nsb.applicationSpec(plan, ns), nsb.logger)
 
 		if err != nil {
 			return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("create application err: %s", err)
 		}
-		if err := nsb.databaseClient.CreateServiceInstance(instanceID, details.RawParameters, details.SpaceGUID); err != nil {
+		serviceDetails, err := json.Marshal(ns)
+		if err != nil {
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
+		if err := nsb.databaseClient.CreateServiceInstance(instanceID, plan.Id, serviceDetails, app.SpaceGuid); err != nil {
 			return brokerapi.ProvisionedServiceSpec{}, err
 		}
+		nsb.recordDeployment(instanceID, deployProvision, app.Guid)
+		return brokerapi.ProvisionedServiceSpec{DashboardURL: nsb.dashboardURL(service, instanceID)}, nil
 	} else {
-		return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("user provision parameter must be open, now is %s", nsb.allowUserProvisionParameters)
+		return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("user provision parameter must be open, now is %t", nsb.allowUserProvisionParameters)
 	}
-	return brokerapi.ProvisionedServiceSpec{}, nil
 }
 
 func (nsb *NginxDataflowServiceBroker)Deprovision(context context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error){
@@ -187,6 +301,9 @@ func (nsb *NginxDataflowServiceBroker)Deprovision(context context.Context, insta
 	if service.Name == "" {
 		return brokerapi.DeprovisionServiceSpec{}, fmt.Errorf("service (%s) not found in catalog", details.ServiceID)
 	}
+	//a redeploy in progress would leave its blue application behind
+	unlock := nsb.lockInstance(instanceID)
+	defer unlock()
 	instanceDir := nsb.config.StoreDataDir + instanceID
 	exist, err := nsb.databaseClient.ExistServiceInstance(instanceID)
 	if err != nil {
@@ -203,6 +320,12 @@ func (nsb *NginxDataflowServiceBroker)Deprovision(context context.Context, insta
 		if err := nsb.databaseClient.DeleteServiceInstance(instanceID); err != nil {
 			return brokerapi.DeprovisionServiceSpec{}, err
 		}
+		if err := nsb.databaseClient.DeleteDeployments(instanceID); err != nil {
+			return brokerapi.DeprovisionServiceSpec{}, err
+		}
+		if err := nsb.databaseClient.DeleteRevisions(instanceID); err != nil {
+			return brokerapi.DeprovisionServiceSpec{}, err
+		}
 	} else if exist == false && app.Name != "" {
 		if err := cfClient.DeleteApplcationWorkflow("nginx-flow-" + instanceID, instanceDir, nsb.logger); err != nil {
 			return brokerapi.DeprovisionServiceSpec{}, err
@@ -211,6 +334,12 @@ func (nsb *NginxDataflowServiceBroker)Deprovision(context context.Context, insta
 		if err := nsb.databaseClient.DeleteServiceInstance(instanceID); err != nil {
 			return brokerapi.DeprovisionServiceSpec{}, err
 		}
+		if err := nsb.databaseClient.DeleteDeployments(instanceID); err != nil {
+			return brokerapi.DeprovisionServiceSpec{}, err
+		}
+		if err := nsb.databaseClient.DeleteRevisions(instanceID); err != nil {
+			return brokerapi.DeprovisionServiceSpec{}, err
+		}
 		if err := cfClient.DeleteApplcationWorkflow("nginx-flow-" + instanceID, instanceDir, nsb.logger); err != nil {
 			return brokerapi.DeprovisionServiceSpec{}, err
 		}
@@ -235,6 +364,7 @@ func (nsb *NginxDataflowServiceBroker) LastOperation(context context.Context, in
 func (nsb *NginxDataflowServiceBroker)Update(context context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
 	nsb.logger.Debug("update", lager.Data{
 		"instance_id":        	instanceID,
+		"plan_id":		details.PlanID,
 	})
 	service, _ := nsb.GetService(details.ServiceID)
 	if service.Name == "" {
@@ -247,45 +377,134 @@ func (nsb *NginxDataflowServiceBroker)Update(context context.Context, instanceID
 	if exist == false {
 		return brokerapi.UpdateServiceSpec{}, fmt.Errorf("service instance (%s) already delete", instanceID)
 	}
-	//update
-	if nsb.allowUserUpdateParameters && len(details.GetRawParameters()) >0 {
-		provisionParameters := ProvisionParameters{}
-		sourceDir := nsb.config.StoreDataDir + instanceID
-		destinationDir := nsb.config.StoreDataDir + instanceID + "/" + instanceID + ".zip"
+	unlock := nsb.lockInstance(instanceID)
+	defer unlock()
+	//plan
+	originPlan, err := nsb.instancePlan(instanceID, details.PreviousValues.PlanID)
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	plan := originPlan
+	planChanged := details.PlanID != "" && !strings.EqualFold(details.PlanID, originPlan.Id)
+	if planChanged {
+		plan, _ = nsb.GetPlan(service.Id, details.PlanID)
+		if plan.Name == "" {
+			return brokerapi.UpdateServiceSpec{}, fmt.Errorf("plan (%s) not found in catalog", details.PlanID)
+		}
+	}
+	hasParameters := len(details.GetRawParameters()) > 0
+	if hasParameters && !nsb.allowUserUpdateParameters {
+		return brokerapi.UpdateServiceSpec{}, fmt.Errorf("user update parameter must be open, now is %t", nsb.allowUserUpdateParameters)
+	}
+	if !hasParameters && !planChanged {
+		return brokerapi.UpdateServiceSpec{}, nil
+	}
+	provisionParameters := ProvisionParameters{}
+	if hasParameters {
 		if jsonErr := json.Unmarshal(details.RawParameters, &provisionParameters); jsonErr != nil {
 			return brokerapi.UpdateServiceSpec{}, jsonErr
 		}
-		ns , err := nsb.ParseParameters(instanceID, provisionParameters)
+	}
+	if value, ok := provisionParameters["rollback_to"]; ok {
+		if len(provisionParameters) > 1 || planChanged {
+			return brokerapi.UpdateServiceSpec{}, fmt.Errorf("parameter rollback_to must not be set with other parameters or a plan change")
+		}
+		revision, ok := value.(float64)
+		if !ok || revision != float64(int(revision)) {
+			return brokerapi.UpdateServiceSpec{}, fmt.Errorf("parameter rollback_to must be a revision number")
+		}
+		return brokerapi.UpdateServiceSpec{}, nsb.rollback(instanceID, originPlan, int(revision))
+	}
+	//space migration, by a plan change between system space and tenant space plans or the use_system_space parameter
+	app, err := cfClient.GetApplicationWorkflow("nginx-flow-" + instanceID, nsb.logger)
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	if app.Guid == "" {
+		return brokerapi.UpdateServiceSpec{}, fmt.Errorf("the nginx application of service instance (%s) not found", instanceID)
+	}
+	inSystemSpace := app.SpaceGuid == nsb.serviceSpaceGuid
+	useSystemSpace := inSystemSpace
+	if planChanged && originPlan.EnableSystemSpace != plan.EnableSystemSpace {
+		useSystemSpace = plan.EnableSystemSpace
+	}
+	if value, ok := provisionParameters["use_system_space"]; ok {
+		if useSystemSpace, ok = value.(bool); !ok {
+			return brokerapi.UpdateServiceSpec{}, fmt.Errorf("parameter use_system_space must be a boolean")
+		}
+	}
+	targetSpaceGuid := app.SpaceGuid
+	if useSystemSpace != inSystemSpace {
+		if useSystemSpace {
+			targetSpaceGuid = nsb.serviceSpaceGuid
+		} else {
+			targetSpaceGuid = details.PreviousValues.SpaceID
+		}
+		if targetSpaceGuid == "" {
+			return brokerapi.UpdateServiceSpec{}, fmt.Errorf("the tenant space of service instance (%s) is unknown", instanceID)
+		}
+	}
+	//update
+	sourceDir := nsb.config.StoreDataDir + instanceID
+	destinationDir := nsb.config.StoreDataDir + instanceID + "/" + instanceID + ".zip"
+	ns, err := nsb.databaseClient.GetServiceInstance(instanceID)
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	originNs := ns
+	if hasParameters {
+		ns, err = nsb.ParseParameters(ns, provisionParameters)
 		if err != nil {
 			return brokerapi.UpdateServiceSpec{}, err
 		}
-		err = nsb.PreparePushDir(instanceID, ns)
-		if err != nil {
+	}
+	ns.ServiceId = instanceID
+	if err := checkPlan(plan, ns); err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	//a change of routes only is mapped to the running nginx application
+	if !planChanged && targetSpaceGuid == app.SpaceGuid && onlyRoutesChanged(originNs, ns) {
+		if err := cfClient.UpdateApplicationRoutesWorkflow("nginx-flow-" + instanceID, nsb.applicationSpec(plan, ns).Routes, nsb.logger); err != nil {
 			return brokerapi.UpdateServiceSpec{}, err
 		}
-		var spaceName string
-		plan, err := nsb.GetPlan(service.Id, details.PlanID)
+		serviceDetails, err := json.Marshal(ns)
 		if err != nil {
 			return brokerapi.UpdateServiceSpec{}, err
 		}
-		if plan.EnableSystemSpace {
-			spaceName = nsb.config.ServiceSpace
-		} else {
-			space, err := cfClient.GetSpaceWorkflow(details.PreviousValues.SpaceID, nsb.logger)
-			if err != nil {
-				return brokerapi.UpdateServiceSpec{}, err
-			}
-			spaceName = space.Name
-		}
-		_, err = cfClient.UpdateApplicationWorkflow("nginx-flow-" + instanceID, spaceName, ns.Host, ns.Domain, sourceDir, destinationDir, nsb.logger)
+		return brokerapi.UpdateServiceSpec{}, nsb.databaseClient.UpdateServiceInstance(instanceID, serviceDetails)
+	}
+	if err := nsb.reserveTcpRoute(&ns, targetSpaceGuid); err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	err = nsb.PreparePushDir(instanceID, ns)
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	if targetSpaceGuid != app.SpaceGuid {
+		app, err = cfClient.MigrateApplicationWorkflow("nginx-flow-" + instanceID, targetSpaceGuid, sourceDir, destinationDir, nsb.applicationSpec(plan, ns), nsb.logger)
 		if err != nil {
 			return brokerapi.UpdateServiceSpec{}, err
 		}
-		if err := nsb.databaseClient.UpdateServiceInstance(instanceID, details.RawParameters); err != nil {
+		if err := nsb.databaseClient.UpdateServiceInstanceSpace(instanceID, app.SpaceGuid); err != nil {
 			return brokerapi.UpdateServiceSpec{}, err
 		}
+		nsb.recordDeployment(instanceID, deployMigrate, app.Guid)
 	} else {
-		return brokerapi.UpdateServiceSpec{}, fmt.Errorf("user provision parameter must be open, now is %s", nsb.allowUserUpdateParameters)
+		app, err = cfClient.UpdateApplicationWorkflow("nginx-flow-" + instanceID, sourceDir, destinationDir, nsb.applicationSpec(plan, ns), nsb.logger)
+		if err != nil {
+			return brokerapi.UpdateServiceSpec{}, err
+		}
+		nsb.recordDeployment(instanceID, deployUpdate, app.Guid)
+	}
+	serviceDetails, err := json.Marshal(ns)
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	if err := nsb.databaseClient.UpdateServiceInstance(instanceID, serviceDetails); err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	if err := nsb.databaseClient.UpdateServiceInstancePlan(instanceID, plan.Id); err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
 	}
 	return brokerapi.UpdateServiceSpec{}, nil
 }
@@ -294,134 +513,159 @@ func (nsb *NginxDataflowServiceBroker) Bind(context context.Context, instanceID,
 	nsb.logger.Debug("bind", lager.Data{
 		"instance_id":        	instanceID,
 	})
-	credentials := make(map[string]interface{})
+	bindNginx, err := nsb.newBindingNginx(instanceID, bindingID, details)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	ns, err := nsb.attachBinding(instanceID, details.PlanID, bindNginx)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	return brokerapi.Binding{
+		Credentials:    bindingCredentials(ns),
+		SyslogDrainURL: nsb.bindingSyslogDrain(details.ServiceID, ns),
+	}, nil
+}
+
+// newBindingNginx checks the bind request and resolves the proxied url and weight
+func (nsb *NginxDataflowServiceBroker) newBindingNginx(instanceID, bindingID string, details brokerapi.BindDetails) (route.Nginx, error) {
 	service, _ := nsb.GetService(details.ServiceID)
 	if service.Name == "" {
-		return brokerapi.Binding{}, fmt.Errorf("service (%s) not found in catalog", details.ServiceID)
+		return route.Nginx{}, fmt.Errorf("service (%s) not found in catalog", details.ServiceID)
 	}
-	//random port generate
-	//TODO memory store
-	ports := make([]int, 0)
-	for i := 8001; i <= 8001 + nsb.config.NginxBackendInstanceNum ; i++ {
-		ports = append(ports, i)
+	if !nsb.allowUserBindParameters {
+		return route.Nginx{}, fmt.Errorf("user bind parameter must be open, now is %t", nsb.allowUserBindParameters)
 	}
 	//check service instance exist
 	exist, err := nsb.databaseClient.ExistServiceInstance(instanceID)
 	if err != nil {
-		return brokerapi.Binding{}, err
+		return route.Nginx{}, err
 	}
 	if exist == false {
-		return brokerapi.Binding{}, brokerapi.ErrInstanceDoesNotExist
+		return route.Nginx{}, brokerapi.ErrInstanceDoesNotExist
 	}
 	//get bind service's application
 	bindApp, err := cfClient.GetApplicationWithGuidWorkflow(details.AppGUID, nsb.logger)
 	if err != nil {
-		return brokerapi.Binding{}, err
+		return route.Nginx{}, err
 	}
-	//get service instance details form db
-	ns, err := nsb.databaseClient.GetServiceInstance(instanceID)
-	if err != nil {
-		return brokerapi.Binding{}, err
-	}
-	if nsb.allowUserBindParameters {
-		bindParameters := BindParameters{}
-		var bindNginx route.Nginx
-		sourceDir := nsb.config.StoreDataDir + instanceID
-		destinationDir := nsb.config.StoreDataDir + instanceID + "/" + instanceID + ".zip"
-		if len(details.GetRawParameters()) >0 {
-			if jsonErr := json.Unmarshal(details.RawParameters, &bindParameters); jsonErr != nil {
-				return brokerapi.Binding{}, jsonErr
-			}
-			bindNginx = nsb.ParseBindParameters(instanceID, bindingID, bindParameters)
-		}else {
-			bindNginx.Name = bindingID
-		}
-		//when bind url param is null
-		if bindNginx.Url == "" {
-			routes, err := cfClient.GetApplicationRouteWorkflow(bindApp.Guid, nsb.logger)
-			if err != nil {
-				return brokerapi.Binding{}, err
-			}
-			//pick one route from application
-			if len(routes) >0 {
-				host := routes[0].Host
-				domain, err := cfClient.GetDomainWorkflow(routes[0].DomainGuid, nsb.logger)
-				if err != nil {
-					return brokerapi.Binding{}, err
-				}
-				bindNginx.Url = host + "." + domain.Name
-				if bindNginx.Weight == 0 {
-					bindNginx.Weight = 5
-				}
-			}else {
-				return brokerapi.Binding{}, fmt.Errorf("the bind application %s has no route, and bind parameter has not set url parameter", bindApp.Name)
-			}
-		}
-		//check the origin url exist
-		for _, originNginx := range ns.Nginxs {
-			if originNginx.Url == bindNginx.Url {
-				return brokerapi.Binding{}, fmt.Errorf("the bind url(%s) has already exist in origin nginxs(%s)", bindNginx.Url, ns.Nginxs)
-			}
-		}
-		//set a port
-		for _, n := range ns.Nginxs {
-			for index, p := range ports {
-				if n.Port == p {
-					ports = append(ports[:index], ports[index+1:]...)
-					break
-				}
-			}
-		}
-		bindNginx.Port = ports[1]
-		//set weight
-		if bindNginx.Weight == 0 {
-			bindNginx.Weight = 5
+	bindParameters := BindParameters{}
+	var bindNginx route.Nginx
+	if len(details.GetRawParameters()) >0 {
+		if jsonErr := json.Unmarshal(details.RawParameters, &bindParameters); jsonErr != nil {
+			return route.Nginx{}, jsonErr
 		}
-		//revert origin nginxs
-		ns.Nginxs = append(ns.Nginxs, bindNginx)
-		ns.ServiceId = instanceID
-		newRawParameters, err := json.Marshal(ns)
+		bindNginx, err = nsb.ParseBindParameters(instanceID, bindingID, bindParameters)
 		if err != nil {
-			return brokerapi.Binding{}, err
+			return route.Nginx{}, err
 		}
-		err = nsb.PreparePushDir(instanceID, ns)
+	}else {
+		bindNginx.Name = bindingID
+	}
+	bindNginx.AppGuid = bindApp.Guid
+	//register an internal route for the bound app, nginx reaches it over container-to-container networking
+	if bindNginx.Internal {
+		if bindNginx.Url != "" {
+			return route.Nginx{}, fmt.Errorf("bind parameters url and internal must not be set together")
+		}
+		bindNginx.Url, err = cfClient.MapInternalRouteWorkflow(bindApp.Guid, internalHost(bindApp.Name), nsb.logger)
 		if err != nil {
-			return brokerapi.Binding{}, err
+			return route.Nginx{}, err
 		}
-		var spaceName string
-		plan, err := nsb.GetPlan(service.Id, details.PlanID)
+	}
+	//when bind url param is null
+	if bindNginx.Url == "" {
+		routes, err := cfClient.GetApplicationRouteWorkflow(bindApp.Guid, nsb.logger)
 		if err != nil {
-			return brokerapi.Binding{}, err
+			return route.Nginx{}, err
 		}
-		if plan.EnableSystemSpace {
-			spaceName = nsb.config.ServiceSpace
-		} else {
-			requestContext := RequestContext{}
-			if err = json.Unmarshal(details.RawContext, &requestContext); err != nil {
-				return brokerapi.Binding{}, err
-			}
-			space, err := cfClient.GetSpaceWorkflow(requestContext["space_guid"], nsb.logger)
+		//pick one route from application
+		if len(routes) >0 {
+			host := routes[0].Host
+			domain, err := cfClient.GetDomainWorkflow(routes[0].DomainGuid, nsb.logger)
 			if err != nil {
-				return brokerapi.Binding{}, err
+				return route.Nginx{}, err
 			}
-			spaceName = space.Name
+			bindNginx.Url = host + "." + domain.Name
+			bindNginx.Internal = domain.Internal
+		}else {
+			return route.Nginx{}, fmt.Errorf("the bind application %s has no route, and bind parameter has not set url parameter", bindApp.Name)
 		}
-		_, err = cfClient.UpdateApplicationWorkflow("nginx-flow-" + instanceID, spaceName, ns.Host, ns.Domain, sourceDir, destinationDir, nsb.logger)
+	}
+	//internal routes skip the gorouter, the container listens on 8080 itself
+	if bindNginx.Internal && bindNginx.BackendPort == 0 {
+		bindNginx.BackendPort = 8080
+	}
+	//grpc needs http/2 end to end, the gorouter only forwards http/1.1
+	if bindNginx.Protocol == route.ProtocolGrpc {
+		if bindNginx.BackendPort == 0 {
+			return route.Nginx{}, fmt.Errorf("a grpc binding needs the backend_port parameter or an internal route")
+		}
+		ns, err := nsb.databaseClient.GetServiceInstance(instanceID)
 		if err != nil {
-			return brokerapi.Binding{}, err
+			return route.Nginx{}, err
 		}
-		if err := nsb.databaseClient.UpdateServiceInstance(instanceID, newRawParameters); err != nil {
-			return brokerapi.Binding{}, err
+		if ns.TcpRoute == nil {
+			return route.Nginx{}, fmt.Errorf("service instance (%s) has no tcp route, update it with the tcp_route parameter before binding grpc applications", instanceID)
 		}
-		credentials["host"] = ns.Host
-		credentials["domain"] = ns.Domain
-		credentials["nginxs"] = ns.Nginxs
-	}else {
-		return brokerapi.Binding{}, fmt.Errorf("user bind parameter must be open, now is %s", nsb.allowUserUpdateParameters)
 	}
-	return brokerapi.Binding{
-		Credentials:    credentials,
-	}, nil
+	//set weight, a mirror is not balanced
+	if bindNginx.Mirror() {
+		bindNginx.Weight = 0
+	} else if bindNginx.Weight == 0 {
+		bindNginx.Weight = 5
+	}
+	return bindNginx, nil
+}
+
+// attachBinding adds the nginx backend to the stored service instance and redeploys the nginx application
+func (nsb *NginxDataflowServiceBroker) attachBinding(instanceID, planID string, bindNginx route.Nginx) (route.NginxService, error) {
+	unlock := nsb.lockInstance(instanceID)
+	defer unlock()
+
+	plan, err := nsb.instancePlan(instanceID, planID)
+	if err != nil {
+		return route.NginxService{}, err
+	}
+	if err := checkPlanProxy(plan, bindNginx.Proxy); err != nil {
+		return route.NginxService{}, err
+	}
+
+	sourceDir := nsb.config.StoreDataDir + instanceID
+	destinationDir := nsb.config.StoreDataDir + instanceID + "/" + instanceID + ".zip"
+	//get service instance details form db
+	ns, err := nsb.databaseClient.GetServiceInstance(instanceID)
+	if err != nil {
+		return route.NginxService{}, err
+	}
+	//check the origin url exist
+	for _, originNginx := range ns.Nginxs {
+		if originNginx.Url == bindNginx.Url {
+			return route.NginxService{}, fmt.Errorf("the bind url(%s) has already exist in origin nginxs(%v)", bindNginx.Url, ns.Nginxs)
+		}
+	}
+	//set a port
+	bindNginx.Port = nsb.backendPort(ns)
+	//revert origin nginxs
+	ns.Nginxs = append(ns.Nginxs, bindNginx)
+	ns.ServiceId = instanceID
+	newRawParameters, err := json.Marshal(ns)
+	if err != nil {
+		return route.NginxService{}, err
+	}
+	err = nsb.PreparePushDir(instanceID, ns)
+	if err != nil {
+		return route.NginxService{}, err
+	}
+	app, err := cfClient.UpdateApplicationWorkflow("nginx-flow-" + instanceID, sourceDir, destinationDir, nsb.applicationSpec(plan, ns), nsb.logger)
+	if err != nil {
+		return route.NginxService{}, err
+	}
+	nsb.recordDeployment(instanceID, deployBind, app.Guid)
+	if err := nsb.databaseClient.UpdateServiceInstance(instanceID, newRawParameters); err != nil {
+		return route.NginxService{}, err
+	}
+	return ns, nil
 }
 
 func (nsb *NginxDataflowServiceBroker) Unbind(context context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
@@ -442,53 +686,58 @@ func (nsb *NginxDataflowServiceBroker) Unbind(context context.Context, instanceI
 	if exist == false {
 		return brokerapi.ErrBindingDoesNotExist
 	}
-	//check service instance exist
-	appExist, err := cfClient.CheckApplicationExistWorkflow("nginx-flow-" + instanceID, nsb.logger)
+	//an async bind may still deploy the nginx application
+	operation, err := nsb.bindingOperation(bindingID)
 	if err != nil {
 		return err
 	}
-	if appExist == false {
-		return brokerapi.ErrBindingDoesNotExist
+	if brokerapi.LastOperationState(operation.State) == brokerapi.InProgress {
+		return ErrBindingInProgress
 	}
+	unlock := nsb.lockInstance(instanceID)
+	defer unlock()
 	//get service instance details form db
 	ns, err := nsb.databaseClient.GetServiceInstance(instanceID)
 	if err != nil {
 		return err
 	}
-	//check the bindId and url exist
+	//the stored backends tell whether the binding was deployed
+	attached := false
 	for index, n := range ns.Nginxs {
 		if n.Name == bindingID {
 			ns.Nginxs = append(ns.Nginxs[:index], ns.Nginxs[index+1:]...)
+			attached = true
 			break
 		}
 	}
+	if !attached {
+		if operation.State == "" {
+			return brokerapi.ErrBindingDoesNotExist
+		}
+		return nsb.databaseClient.DeleteBindingOperation(bindingID)
+	}
+	//check service instance exist
+	appExist, err := cfClient.CheckApplicationExistWorkflow("nginx-flow-" + instanceID, nsb.logger)
+	if err != nil {
+		return err
+	}
+	if appExist == false {
+		return brokerapi.ErrBindingDoesNotExist
+	}
 	//update instance
 	err = nsb.PreparePushDir(instanceID, ns)
 	if err != nil {
 		return err
 	}
-	var spaceName string
-	plan, err := nsb.GetPlan(service.Id, details.PlanID)
+	plan, err := nsb.instancePlan(instanceID, details.PlanID)
 	if err != nil {
 		return err
 	}
-	if plan.EnableSystemSpace {
-		spaceName = nsb.config.ServiceSpace
-	} else {
-		spaceId, err := nsb.databaseClient.GetSpaceWithServiceId(instanceID)
-		if err != nil {
-			return err
-		}
-		space, err := cfClient.GetSpaceWorkflow(spaceId, nsb.logger)
-		if err != nil {
-			return err
-		}
-		spaceName = space.Name
-	}
-	_, err = cfClient.UpdateApplicationWorkflow("nginx-flow-" + instanceID, spaceName, ns.Host, ns.Domain, sourceDir, destinationDir, nsb.logger)
+	app, err := cfClient.UpdateApplicationWorkflow("nginx-flow-" + instanceID, sourceDir, destinationDir, nsb.applicationSpec(plan, ns), nsb.logger)
 	if err != nil {
 		return err
 	}
+	nsb.recordDeployment(instanceID, deployUnbind, app.Guid)
 	//revert database
 	newNginxParameters, err := json.Marshal(ns)
 	if err != nil {
@@ -497,12 +746,18 @@ func (nsb *NginxDataflowServiceBroker) Unbind(context context.Context, instanceI
 	if err = nsb.databaseClient.UpdateServiceInstance(instanceID, newNginxParameters); err != nil {
 		return err
 	}
-	return nil
+	return nsb.databaseClient.DeleteBindingOperation(bindingID)
 }
 
-func (nsb *NginxDataflowServiceBroker)ParseParameters(instanceId string, parameters map[string]interface{}) (route.NginxService, error){
-	ns := route.NginxService{
-		ServiceId:	instanceId,
+// ParseParameters applies the provision or update parameters on top of ns
+func (nsb *NginxDataflowServiceBroker)ParseParameters(ns route.NginxService, parameters map[string]interface{}) (route.NginxService, error){
+	//instances created before the statistics get their status path on the next update
+	if ns.StatusPath == "" {
+		statusPath, err := route.NewStatusPath()
+		if err != nil {
+			return route.NginxService{}, err
+		}
+		ns.StatusPath = statusPath
 	}
 	for serviceKey, serviceValue := range parameters {
 		if serviceKey == "nginxs" {
@@ -512,6 +767,11 @@ func (nsb *NginxDataflowServiceBroker)ParseParameters(instanceId string, paramet
 			if err != nil {
 				return route.NginxService{}, err
 			}
+			for _, n := range nginxs {
+				if err := n.ValidateRole(); err != nil {
+					return route.NginxService{}, err
+				}
+			}
 			ns.Nginxs = nginxs
 		}
 		if serviceKey == "host" {
@@ -523,11 +783,236 @@ func (nsb *NginxDataflowServiceBroker)ParseParameters(instanceId string, paramet
 		if serviceKey == "enable_session_sticky" {
 			ns.SessionSticky = serviceValue.(bool)
 		}
+		if serviceKey == "sticky" {
+			var sticky route.Stickiness
+			if err := decodeParameter(serviceValue, &sticky); err != nil {
+				return route.NginxService{}, fmt.Errorf("parameter sticky err: %s", err)
+			}
+			if err := sticky.Validate(); err != nil {
+				return route.NginxService{}, err
+			}
+			ns.Sticky = sticky
+		}
+		if serviceKey == "headers" {
+			var headers route.Headers
+			if err := decodeParameter(serviceValue, &headers); err != nil {
+				return route.NginxService{}, fmt.Errorf("parameter headers err: %s", err)
+			}
+			if err := headers.Validate(); err != nil {
+				return route.NginxService{}, err
+			}
+			ns.Headers = headers
+		}
+		if serviceKey == "cache" {
+			var cache route.Cache
+			if err := decodeParameter(serviceValue, &cache); err != nil {
+				return route.NginxService{}, fmt.Errorf("parameter cache err: %s", err)
+			}
+			if err := cache.Validate(); err != nil {
+				return route.NginxService{}, err
+			}
+			ns.Cache = cache
+		}
+		if serviceKey == "access" {
+			var access route.Access
+			if err := decodeParameter(serviceValue, &access); err != nil {
+				return route.NginxService{}, fmt.Errorf("parameter access err: %s", err)
+			}
+			//a user given without password keeps its stored password
+			access.KeepStoredHashes(ns.Access)
+			if err := access.Validate(); err != nil {
+				return route.NginxService{}, err
+			}
+			if err := access.HashPasswords(); err != nil {
+				return route.NginxService{}, err
+			}
+			ns.Access = access
+		}
+		if serviceKey == "proxy" {
+			var proxy route.Proxy
+			if err := decodeParameter(serviceValue, &proxy); err != nil {
+				return route.NginxService{}, fmt.Errorf("parameter proxy err: %s", err)
+			}
+			if err := proxy.Validate(); err != nil {
+				return route.NginxService{}, err
+			}
+			ns.Proxy = proxy
+		}
+		if serviceKey == "error_pages" {
+			var pages map[string]route.ErrorPage
+			if err := decodeParameter(serviceValue, &pages); err != nil {
+				return route.NginxService{}, fmt.Errorf("parameter error_pages err: %s", err)
+			}
+			if err := route.ValidateErrorPages(pages); err != nil {
+				return route.NginxService{}, err
+			}
+			if err := fetchErrorPages(pages); err != nil {
+				return route.NginxService{}, err
+			}
+			ns.ErrorPages = pages
+		}
+		if serviceKey == "maintenance" {
+			maintenance, err := boolParameter(serviceKey, serviceValue)
+			if err != nil {
+				return route.NginxService{}, err
+			}
+			ns.Maintenance = maintenance
+		}
+		if serviceKey == "retry_after" {
+			retryAfter, err := intParameter(serviceKey, serviceValue)
+			if err != nil {
+				return route.NginxService{}, err
+			}
+			ns.RetryAfter = retryAfter
+			if ns.RetryAfter < 0 {
+				return route.NginxService{}, fmt.Errorf("parameter retry_after must not be negative")
+			}
+		}
+		if serviceKey == "rewrites" {
+			var rewrites []route.RewriteRule
+			if err := decodeParameter(serviceValue, &rewrites); err != nil {
+				return route.NginxService{}, fmt.Errorf("parameter rewrites err: %s", err)
+			}
+			ns.Rewrites = rewrites
+		}
+		if serviceKey == "access_log" {
+			accessLog, err := stringParameter(serviceKey, serviceValue)
+			if err != nil {
+				return route.NginxService{}, err
+			}
+			ns.AccessLog = accessLog
+			if err := route.ValidateAccessLog(ns.AccessLog); err != nil {
+				return route.NginxService{}, err
+			}
+		}
+		if serviceKey == "syslog_drain_url" {
+			syslogDrainUrl, err := stringParameter(serviceKey, serviceValue)
+			if err != nil {
+				return route.NginxService{}, err
+			}
+			ns.SyslogDrainUrl = syslogDrainUrl
+			if ns.SyslogDrainUrl != "" {
+				if err := route.ValidateSyslogDrainUrl(ns.SyslogDrainUrl); err != nil {
+					return route.NginxService{}, err
+				}
+			}
+		}
+		if serviceKey == "tcp_route" {
+			if enable, ok := serviceValue.(bool); ok {
+				if !enable {
+					ns.TcpRoute = nil
+				} else if ns.TcpRoute == nil {
+					ns.TcpRoute = &route.TcpRoute{}
+				}
+				continue
+			}
+			var tcpRoute route.TcpRoute
+			if err := decodeParameter(serviceValue, &tcpRoute); err != nil {
+				return route.NginxService{}, fmt.Errorf("parameter tcp_route err: %s", err)
+			}
+			//the platform picks the port, a stored route of the same domain is kept
+			if ns.TcpRoute != nil && (tcpRoute.Domain == "" || tcpRoute.Domain == ns.TcpRoute.Domain) {
+				continue
+			}
+			tcpRoute.Port = 0
+			ns.TcpRoute = &tcpRoute
+		}
+		if serviceKey == "routes" {
+			var routes []route.Route
+			if err := decodeParameter(serviceValue, &routes); err != nil {
+				return route.NginxService{}, fmt.Errorf("parameter routes err: %s", err)
+			}
+			ns.Routes = routes
+		}
+	}
+	//add and remove apply on top of the routes parameter
+	if value, ok := parameters["add_routes"]; ok {
+		var routes []route.Route
+		if err := decodeParameter(value, &routes); err != nil {
+			return route.NginxService{}, fmt.Errorf("parameter add_routes err: %s", err)
+		}
+		ns.Routes = append(ns.Routes, routes...)
+	}
+	if value, ok := parameters["remove_routes"]; ok {
+		var routes []route.Route
+		if err := decodeParameter(value, &routes); err != nil {
+			return route.NginxService{}, fmt.Errorf("parameter remove_routes err: %s", err)
+		}
+		kept := make([]route.Route, 0)
+		for _, r := range ns.Routes {
+			removed := false
+			for _, remove := range routes {
+				if r.Equal(remove) {
+					removed = true
+				}
+			}
+			if !removed {
+				kept = append(kept, r)
+			}
+		}
+		ns.Routes = kept
+	}
+	for _, r := range ns.AllRoutes() {
+		if err := r.Validate(); err != nil {
+			return route.NginxService{}, err
+		}
+	}
+	//the redirects are followed on the final routes
+	if err := ns.ValidateRewrites(); err != nil {
+		return route.NginxService{}, err
+	}
+	//the tcp router does not forward the client address, nginx could only check the router's
+	if ns.TcpRoute != nil && ns.Access.Restricted() {
+		return route.NginxService{}, fmt.Errorf("access allow and deny lists can not be enforced on the tcp route")
+	}
+	if ns.TcpRoute == nil && len(ns.GrpcNginxs()) > 0 {
+		return route.NginxService{}, fmt.Errorf("the tcp route serves the grpc bindings, unbind them before removing it")
 	}
 	return ns, nil
 }
 
-func (nsb *NginxDataflowServiceBroker)ParseBindParameters(instanceId string, bindId string,parameters map[string]interface{}) (route.Nginx) {
+// decodeParameter decodes a structured parameter, given either as json or as a json string
+func decodeParameter(value interface{}, target interface{}) error {
+	if s, ok := value.(string); ok {
+		return json.Unmarshal([]byte(s), target)
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, target)
+}
+
+func invalidParameter(key, kind string) error {
+	return brokerapi.NewFailureResponse(fmt.Errorf("parameter %s must be %s", key, kind), http.StatusUnprocessableEntity, "invalid-parameter")
+}
+
+func stringParameter(key string, value interface{}) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", invalidParameter(key, "a string")
+	}
+	return s, nil
+}
+
+func boolParameter(key string, value interface{}) (bool, error) {
+	b, ok := value.(bool)
+	if !ok {
+		return false, invalidParameter(key, "a boolean")
+	}
+	return b, nil
+}
+
+//json numbers decode to float64
+func intParameter(key string, value interface{}) (int, error) {
+	f, ok := value.(float64)
+	if !ok || f != float64(int(f)) {
+		return 0, invalidParameter(key, "an integer")
+	}
+	return int(f), nil
+}
+
+func (nsb *NginxDataflowServiceBroker)ParseBindParameters(instanceId string, bindId string,parameters map[string]interface{}) (route.Nginx, error) {
 	nb := route.Nginx{
 		Name:        bindId,
 	}
@@ -538,8 +1023,65 @@ func (nsb *NginxDataflowServiceBroker)ParseBindParameters(instanceId string, bin
 		if bindKey == "weight" {
 			nb.Weight = int(bindValue.(float64))
 		}
+		if bindKey == "backend_port" {
+			backendPort, err := intParameter(bindKey, bindValue)
+			if err != nil {
+				return route.Nginx{}, err
+			}
+			nb.BackendPort = backendPort
+		}
+		if bindKey == "internal" {
+			internal, err := boolParameter(bindKey, bindValue)
+			if err != nil {
+				return route.Nginx{}, err
+			}
+			nb.Internal = internal
+		}
+		if bindKey == "proxy" {
+			if err := decodeParameter(bindValue, &nb.Proxy); err != nil {
+				return route.Nginx{}, fmt.Errorf("bind parameter proxy err: %s", err)
+			}
+			if err := nb.Proxy.ValidateBinding(); err != nil {
+				return route.Nginx{}, err
+			}
+		}
+		if bindKey == "protocol" {
+			protocol, err := stringParameter(bindKey, bindValue)
+			if err != nil {
+				return route.Nginx{}, err
+			}
+			nb.Protocol = protocol
+			if err := route.ValidateProtocol(nb.Protocol); err != nil {
+				return route.Nginx{}, err
+			}
+		}
+		if bindKey == "role" {
+			role, err := stringParameter(bindKey, bindValue)
+			if err != nil {
+				return route.Nginx{}, err
+			}
+			nb.Role = role
+		}
+		if bindKey == "mirror_percent" {
+			mirrorPercent, err := intParameter(bindKey, bindValue)
+			if err != nil {
+				return route.Nginx{}, err
+			}
+			nb.MirrorPercent = mirrorPercent
+		}
+		if bindKey == "headers" {
+			if err := decodeParameter(bindValue, &nb.Headers); err != nil {
+				return route.Nginx{}, fmt.Errorf("bind parameter headers err: %s", err)
+			}
+			if err := nb.Headers.Validate(); err != nil {
+				return route.Nginx{}, err
+			}
+		}
 	}
-	return nb
+	if err := nb.ValidateRole(); err != nil {
+		return route.Nginx{}, err
+	}
+	return nb, nil
 }
 
 func (nsb *NginxDataflowServiceBroker)GetService(serviceId string) (config.Service, error) {
@@ -563,6 +1105,94 @@ func (nsb *NginxDataflowServiceBroker)GetPlan(serviceId, planId string) (config.
 	}
 	return *new(config.Plan), nil
 }
+func (nsb *NginxDataflowServiceBroker)GetPlanWithId(planId string) (config.Service, config.Plan) {
+	for _,s := range nsb.config.Services {
+		for _,p := range s.Plans {
+			if strings.EqualFold(p.Id, planId){
+				return s, p
+			}
+		}
+	}
+	return *new(config.Service), *new(config.Plan)
+}
+
+// instancePlan falls back to the plan of the request for instances stored without one
+func (nsb *NginxDataflowServiceBroker)instancePlan(instanceID, requestPlanID string) (config.Plan, error) {
+	planId, err := nsb.databaseClient.GetPlanWithServiceId(instanceID)
+	if err != nil {
+		return config.Plan{}, err
+	}
+	if planId == "" {
+		planId = requestPlanID
+	}
+	_, plan := nsb.GetPlanWithId(planId)
+	if plan.Name == "" {
+		return config.Plan{}, fmt.Errorf("plan (%s) not found in catalog", planId)
+	}
+	return plan, nil
+}
+
+// redeploy blue-green deploys the nginx application again from the stored service instance
+func (nsb *NginxDataflowServiceBroker) redeploy(instanceID, operation string) error {
+	if err := nsb.checkReconciler(); err != nil {
+		return err
+	}
+	unlock := nsb.lockInstance(instanceID)
+	defer unlock()
+
+	exist, err := nsb.databaseClient.ExistServiceInstance(instanceID)
+	if err != nil {
+		return err
+	}
+	if exist == false {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+	plan, err := nsb.instancePlan(instanceID, "")
+	if err != nil {
+		return err
+	}
+	ns, err := nsb.databaseClient.GetServiceInstance(instanceID)
+	if err != nil {
+		return err
+	}
+	ns.ServiceId = instanceID
+	return nsb.deploy(instanceID, plan, ns, operation)
+}
+
+// deploy renders ns and blue-green deploys the nginx application with it, the caller holds the instance lock
+func (nsb *NginxDataflowServiceBroker) deploy(instanceID string, plan config.Plan, ns route.NginxService, operation string) error {
+	sourceDir := nsb.config.StoreDataDir + instanceID
+	destinationDir := nsb.config.StoreDataDir + instanceID + "/" + instanceID + ".zip"
+	if err := nsb.PreparePushDir(instanceID, ns); err != nil {
+		return err
+	}
+	app, err := cfClient.UpdateApplicationWorkflow("nginx-flow-" + instanceID, sourceDir, destinationDir, nsb.applicationSpec(plan, ns), nsb.logger)
+	if err != nil {
+		return err
+	}
+	nsb.recordDeployment(instanceID, operation, app.Guid)
+	return nil
+}
+
+// backendPort picks a port of the nginx backends no binding of ns listens on
+func (nsb *NginxDataflowServiceBroker) backendPort(ns route.NginxService) int {
+	//random port generate
+	//TODO memory store
+	ports := make([]int, 0)
+	for i := 8001; i <= 8001 + nsb.config.NginxBackendInstanceNum ; i++ {
+		ports = append(ports, i)
+	}
+	for _, n := range ns.Nginxs {
+		for index, p := range ports {
+			if n.Port == p {
+				ports = append(ports[:index], ports[index+1:]...)
+				break
+			}
+		}
+	}
+	return ports[1]
+}
+
 // dir data prepare
 func (nsb *NginxDataflowServiceBroker)PreparePushDir(instanceID string, ns route.NginxService) error{
 	pushDir := nsb.config.StoreDataDir + instanceID
@@ -585,7 +1215,32 @@ func (nsb *NginxDataflowServiceBroker)PreparePushDir(instanceID string, ns route
 	if err != nil {
 		return err
 	}
+	if len(ns.Access.BasicAuth) > 0 {
+		err = ioutil.WriteFile(pushDir + "/" + route.HtpasswdFile, ns.Access.Htpasswd(), os.FileMode(0644))
+		if err != nil {
+			return err
+		}
+	}
+	if ns.StatusPath != "" {
+		err = ioutil.WriteFile(pushDir + "/" + route.ProfileFile, ns.StatsProfile(), os.FileMode(0755))
+		if err != nil {
+			return err
+		}
+	}
+	if statuses := ns.ErrorPageStatuses(); len(statuses) > 0 {
+		if err := os.Mkdir(pushDir + "/" + route.ErrorPagesDir, os.FileMode(0755)); err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			err = ioutil.WriteFile(pushDir + "/" + route.ErrorPagesDir + "/" + status + ".html", ns.ErrorPageHtml(status), os.FileMode(0644))
+			if err != nil {
+				return err
+			}
+		}
+	}
 	//nginx config file
+	ns.Resolver = nsb.config.InternalResolver
+	ns.TrustedProxies = nsb.config.TrustedProxies
 	err = route.ParseNginxTemplate(nsb.config.TemplateDir + "nginx.conf.templ", ns, pushDir + "/" + "nginx.conf")
 	if err != nil {
 		return err
@@ -593,6 +1248,169 @@ func (nsb *NginxDataflowServiceBroker)PreparePushDir(instanceID string, ns route
 	return nil
 }
 
+// checkPlan checks the service instance parameters against the limits of the plan
+func checkPlan(plan config.Plan, ns route.NginxService) error {
+	if err := checkPlanRoutes(plan, ns); err != nil {
+		return err
+	}
+	if err := checkPlanCache(plan, ns); err != nil {
+		return err
+	}
+	if err := checkPlanProxy(plan, ns.Proxy); err != nil {
+		return err
+	}
+	for _, n := range ns.Nginxs {
+		if err := checkPlanProxy(plan, n.Proxy); err != nil {
+			return err
+		}
+	}
+	if ns.StickyStrategy() == route.StickyModule && !plan.InstanceConfig.StickyModule {
+		return fmt.Errorf("the buildpack of plan %s has no sticky module, use %s, %s or %s", plan.Name, route.StickyIPHash, route.StickyCookieHash, route.StickyRoutingCookie)
+	}
+	return nil
+}
+
+// checkPlanRoutes enforces the allowed host pattern and the reserved hosts of the plan on the nginx application routes
+func checkPlanRoutes(plan config.Plan, ns route.NginxService) error {
+	for _, r := range ns.AllRoutes() {
+		for _, reserved := range plan.ReservedHosts {
+			if strings.EqualFold(r.Host, reserved) {
+				return fmt.Errorf("host %s is reserved by plan %s", r.Host, plan.Name)
+			}
+		}
+		if plan.AllowedHostPattern == "" {
+			continue
+		}
+		matched, err := regexp.MatchString("^(?:" + plan.AllowedHostPattern + ")$", r.Host)
+		if err != nil {
+			return err
+		}
+		if !matched {
+			return fmt.Errorf("host %s does not match the allowed host pattern %s of plan %s", r.Host, plan.AllowedHostPattern, plan.Name)
+		}
+	}
+	return nil
+}
+
+// checkPlanCache keeps half of the plan disk, 1024M when the plan sets none, for the application and its stats log
+func checkPlanCache(plan config.Plan, ns route.NginxService) error {
+	disk := plan.InstanceConfig.Disk
+	if disk == 0 {
+		disk = 1024
+	}
+	maxSize := disk / 2
+	if ns.StatusPath != "" {
+		maxSize -= route.StatsLogMaxSize
+	}
+	if ns.Cache.Enabled() && ns.Cache.MaxSize > maxSize {
+		return fmt.Errorf("cache max_size_mb %d exceeds %d, half of the disk of plan %s without the stats log", ns.Cache.MaxSize, maxSize, plan.Name)
+	}
+	return nil
+}
+
+// checkPlanProxy enforces the proxy limits of the plan on the settings of a service instance or a binding
+func checkPlanProxy(plan config.Plan, proxy route.Proxy) error {
+	limits := plan.ProxyLimits
+	if limits.MaxTimeout > 0 {
+		for _, timeout := range []int{proxy.ConnectTimeout, proxy.ReadTimeout, proxy.SendTimeout, proxy.KeepaliveTimeout} {
+			if timeout > limits.MaxTimeout {
+				return fmt.Errorf("proxy timeout %d exceeds %d seconds, the limit of plan %s", timeout, limits.MaxTimeout, plan.Name)
+			}
+		}
+	}
+	if limits.MaxClientBodySize > 0 && proxy.ClientMaxBodySize > limits.MaxClientBodySize {
+		return fmt.Errorf("proxy client_max_body_size_mb %d exceeds %d, the limit of plan %s", proxy.ClientMaxBodySize, limits.MaxClientBodySize, plan.Name)
+	}
+	if limits.MaxKeepalive > 0 && proxy.Keepalive > limits.MaxKeepalive {
+		return fmt.Errorf("proxy keepalive %d exceeds %d, the limit of plan %s", proxy.Keepalive, limits.MaxKeepalive, plan.Name)
+	}
+	return nil
+}
+
+func onlyRoutesChanged(origin, ns route.NginxService) bool {
+	originRoutes, routes := origin.AllRoutes(), ns.AllRoutes()
+	origin.Host, origin.Domain, origin.Routes = "", "", nil
+	ns.Host, ns.Domain, ns.Routes = "", "", nil
+	origin.ServiceId, ns.ServiceId = "", ""
+	return reflect.DeepEqual(origin, ns) && !reflect.DeepEqual(originRoutes, routes)
+}
+
+// applicationSpec sends the proxy logs to the drain of the service instance, or else of the broker
+func (nsb *NginxDataflowServiceBroker) applicationSpec(plan config.Plan, ns route.NginxService) cfClient.ApplicationSpec {
+	spec := cfClient.ApplicationSpec{
+		InstanceNum:	plan.InstanceConfig.InstanceNum,
+		Memory:		plan.InstanceConfig.Memory,
+		Disk:		plan.InstanceConfig.Disk,
+		Buildpack:	plan.InstanceConfig.Buildpack,
+		Policies:	networkPolicies(ns),
+		SyslogDrainUrl:	ns.SyslogDrainUrl,
+		Stack:		ns.Stack,
+	}
+	//a plan update or a catalog change of the buildpack wins over an older rotation
+	if ns.Buildpack != "" && ns.RotatedPlanBuildpack == plan.InstanceConfig.Buildpack {
+		spec.Buildpack = ns.Buildpack
+	}
+	if spec.SyslogDrainUrl == "" {
+		spec.SyslogDrainUrl = nsb.config.SyslogDrainUrl
+	}
+	for _, r := range ns.AllRoutes() {
+		spec.Routes = append(spec.Routes, cfClient.AppRoute{Host: r.Host, Domain: r.Domain, Path: r.Path})
+	}
+	if ns.TcpRoute != nil {
+		spec.Routes = append(spec.Routes, cfClient.AppRoute{Domain: ns.TcpRoute.Domain, Port: ns.TcpRoute.Port, AppPort: route.TcpAppPort})
+	}
+	return spec
+}
+
+// reserveTcpRoute asks the tcp router group for a port the first time the service instance wants a tcp route
+func (nsb *NginxDataflowServiceBroker) reserveTcpRoute(ns *route.NginxService, spaceGuid string) error {
+	if ns.TcpRoute == nil || ns.TcpRoute.Port != 0 {
+		return nil
+	}
+	tcpRoute, err := cfClient.CreateTcpRouteWorkflow(ns.TcpRoute.Domain, spaceGuid, nsb.logger)
+	if err != nil {
+		return fmt.Errorf("reserve tcp route err: %s", err)
+	}
+	ns.TcpRoute.Domain = tcpRoute.Domain
+	ns.TcpRoute.Port = tcpRoute.Port
+	return nil
+}
+
+// networkPolicies lists the bound applications nginx reaches over container-to-container networking
+func networkPolicies(ns route.NginxService) []cfClient.NetworkPolicy {
+	policies := make([]cfClient.NetworkPolicy, 0)
+	for _, n := range ns.Nginxs {
+		if n.Internal {
+			policies = append(policies, cfClient.NetworkPolicy{AppGuid: n.AppGuid, Port: n.BackendPort})
+		}
+	}
+	return policies
+}
+
+// internalHost turns an application name into a route host, hosts only allow lowercase letters, digits and dashes
+func internalHost(appName string) string {
+	host := []rune(strings.ToLower(appName))
+	for i, r := range host {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			host[i] = '-'
+		}
+	}
+	return strings.Trim(string(host), "-")
+}
+
+// lockInstance serializes the deploys of a service instance, they share the push dir and the blue app
+func (nsb *NginxDataflowServiceBroker)lockInstance(instanceID string) func() {
+	nsb.instanceLocksMutex.Lock()
+	lock, ok := nsb.instanceLocks[instanceID]
+	if !ok {
+		lock = &sync.Mutex{}
+		nsb.instanceLocks[instanceID] = lock
+	}
+	nsb.instanceLocksMutex.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
 func servicePlans(plans []config.Plan) []brokerapi.ServicePlan {
 	servicePlans := make([]brokerapi.ServicePlan, 0)
 	for _,servicePlan := range plans {
@@ -616,13 +1434,21 @@ func livenessHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("{}"))
 }
 
-func authHandler(noAuthRequired map[*mux.Route]bool) mux.MiddlewareFunc{
+func authHandler(noAuthRequired, adminAuthRequired map[*mux.Route]bool) mux.MiddlewareFunc{
 	validCredentials := func(r *http.Request) bool {
 		if noAuthRequired[mux.CurrentRoute(r)] {
 			return true
 		}
 		user := os.Getenv("USERNAME")
 		pass := os.Getenv("PASSWORD")
+		if adminAuthRequired[mux.CurrentRoute(r)] {
+			//without admin credentials the operator api is closed
+			user = os.Getenv("ADMIN_USERNAME")
+			pass = os.Getenv("ADMIN_PASSWORD")
+			if user == "" || pass == "" {
+				return false
+			}
+		}
 		username, password, ok := r.BasicAuth()
 		if ok && username == user && password == pass {
 			return true
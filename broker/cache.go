@@ -0,0 +1,44 @@
+package broker
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var ErrCacheDisabled = brokerapi.NewFailureResponseBuilder(
+	errors.New("the service instance has no cache"), http.StatusUnprocessableEntity, "cache-disabled",
+).Build()
+
+// PurgeCache empties the cache with a synchronous blue-green redeploy, it takes as long as a push
+func (nsb *NginxDataflowServiceBroker)PurgeCache(instanceID string) error {
+	nsb.logger.Debug("purge-service-instance-cache", lager.Data{
+		"instance_id":        	instanceID,
+	})
+	exist, err := nsb.databaseClient.ExistServiceInstance(instanceID)
+	if err != nil {
+		return err
+	}
+	if exist == false {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+	ns, err := nsb.databaseClient.GetServiceInstance(instanceID)
+	if err != nil {
+		return err
+	}
+	if !ns.Cache.Enabled() {
+		return ErrCacheDisabled
+	}
+	return nsb.redeploy(instanceID, deployPurgeCache)
+}
+
+func (nsb *NginxDataflowServiceBroker)purgeCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if err := nsb.PurgeCache(mux.Vars(r)["instance_id"]); err != nil {
+		respondError(w, err)
+		return
+	}
+	respond(w, http.StatusOK, brokerapi.EmptyResponse{})
+}
@@ -0,0 +1,600 @@
+package broker
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+	"golang.org/x/net/context"
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/wdxxs2z/nginx-flow-osb/config"
+	"github.com/wdxxs2z/nginx-flow-osb/db"
+	"github.com/wdxxs2z/nginx-flow-osb/route"
+	cfClient "github.com/wdxxs2z/nginx-flow-osb/client"
+)
+
+const (
+	dashboardSessionCookie = "nginx_flow_dashboard"
+	dashboardStateCookie   = "nginx_flow_dashboard_state"
+	dashboardHistoryLimit  = 20
+	//the time a user has to sign in at uaa
+	dashboardLoginTimeout  = 10 * time.Minute
+)
+
+var ErrDashboardDisabled = errors.New("no service of the catalog has a dashboard client")
+
+// dashboardSession keeps the uaa token the cloud controller checks the permissions of the user with
+type dashboardSession struct {
+	token           string
+	csrf            string
+	expiry          time.Time
+}
+
+type dashboardLogin struct {
+	next            string
+	expiry          time.Time
+}
+
+// dashboards keeps the sessions in memory, a restart of the broker signs every user out
+type dashboards struct {
+	sync.Mutex
+	oauth           *oauth2.Config
+	sessions        map[string]*dashboardSession
+	logins          map[string]dashboardLogin
+}
+
+type dashboardInstance struct {
+	Id              string
+	Routes          []route.Route
+	Bindings        int
+	Manage          bool
+}
+
+type dashboardInstancePage struct {
+	Id              string
+	Plan            string
+	Routes          []route.Route
+	Maintenance     bool
+	Nginxs          []route.Nginx
+	Deployments     []db.Deployment
+	Config          string
+	Manage          bool
+	Csrf            string
+	Message         string
+	Error           string
+}
+
+//uaa uses the certificates of the platform, which the cloud controller client does not check either
+var dashboardHttpClient = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+}
+
+// dashboardService returns the first service with a dashboard client, the dashboard signs the users in with it
+func (nsb *NginxDataflowServiceBroker) dashboardService() (config.Service, bool) {
+	for _, service := range nsb.config.Services {
+		if service.DashboardClient["id"] != "" {
+			return service, true
+		}
+	}
+	return config.Service{}, false
+}
+
+// dashboardURL is the dashboard page of a service instance, on the host of the redirect uri of the dashboard client
+func (nsb *NginxDataflowServiceBroker) dashboardURL(service config.Service, instanceID string) string {
+	if service.DashboardClient["id"] == "" {
+		return ""
+	}
+	redirect, err := url.Parse(service.DashboardClient["redirect_uri"])
+	if err != nil || redirect.Host == "" {
+		return ""
+	}
+	return redirect.Scheme + "://" + redirect.Host + "/dashboard/instances/" + instanceID
+}
+
+func (nsb *NginxDataflowServiceBroker) dashboardOauth() (*oauth2.Config, error) {
+	nsb.dashboards.Lock()
+	defer nsb.dashboards.Unlock()
+	if nsb.dashboards.oauth != nil {
+		return nsb.dashboards.oauth, nil
+	}
+	service, ok := nsb.dashboardService()
+	if !ok {
+		return nil, ErrDashboardDisabled
+	}
+	endpoint, err := cfClient.GetAuthEndpointWorkflow(nsb.logger)
+	if err != nil {
+		return nil, err
+	}
+	nsb.dashboards.oauth = &oauth2.Config{
+		ClientID:     service.DashboardClient["id"],
+		ClientSecret: service.DashboardClient["secret"],
+		RedirectURL:  service.DashboardClient["redirect_uri"],
+		Scopes:       []string{"openid", "cloud_controller_service_permissions.read"},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  endpoint.AuthEndpoint + "/oauth/authorize",
+			TokenURL: endpoint.TokenEndpoint + "/oauth/token",
+		},
+	}
+	return nsb.dashboards.oauth, nil
+}
+
+// forgetExpired drops the expired sessions and the logins never finished, the caller holds the lock
+func (d *dashboards) forgetExpired() {
+	now := time.Now()
+	for id, session := range d.sessions {
+		if now.After(session.expiry) {
+			delete(d.sessions, id)
+		}
+	}
+	for state, login := range d.logins {
+		if now.After(login.expiry) {
+			delete(d.logins, state)
+		}
+	}
+}
+
+func (nsb *NginxDataflowServiceBroker) dashboardSession(r *http.Request) *dashboardSession {
+	cookie, err := r.Cookie(dashboardSessionCookie)
+	if err != nil {
+		return nil
+	}
+	nsb.dashboards.Lock()
+	defer nsb.dashboards.Unlock()
+	session, ok := nsb.dashboards.sessions[cookie.Value]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(session.expiry) {
+		delete(nsb.dashboards.sessions, cookie.Value)
+		return nil
+	}
+	return session
+}
+
+func (nsb *NginxDataflowServiceBroker) signIn(w http.ResponseWriter, r *http.Request, next string) {
+	oauth, err := nsb.dashboardOauth()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	state, err := randomHex(16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nsb.dashboards.Lock()
+	nsb.dashboards.forgetExpired()
+	nsb.dashboards.logins[state] = dashboardLogin{next: next, expiry: time.Now().Add(dashboardLoginTimeout)}
+	nsb.dashboards.Unlock()
+	http.SetCookie(w, dashboardCookie(r, dashboardStateCookie, state, time.Now().Add(dashboardLoginTimeout)))
+	http.Redirect(w, r, oauth.AuthCodeURL(state), http.StatusFound)
+}
+
+func (nsb *NginxDataflowServiceBroker) dashboardCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	state := r.FormValue("state")
+	cookie, err := r.Cookie(dashboardStateCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		http.Error(w, "invalid login state", http.StatusBadRequest)
+		return
+	}
+	nsb.dashboards.Lock()
+	login, ok := nsb.dashboards.logins[state]
+	delete(nsb.dashboards.logins, state)
+	nsb.dashboards.Unlock()
+	if !ok || time.Now().After(login.expiry) {
+		http.Error(w, "the login expired", http.StatusBadRequest)
+		return
+	}
+	if errorCode := r.FormValue("error"); errorCode != "" {
+		http.Error(w, "login failed: " + errorCode, http.StatusUnauthorized)
+		return
+	}
+	oauth, err := nsb.dashboardOauth()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx := context.WithValue(r.Context(), oauth2.HTTPClient, dashboardHttpClient)
+	token, err := oauth.Exchange(ctx, r.FormValue("code"))
+	if err != nil {
+		nsb.logger.Error("dashboard-token-exchange", err, lager.Data{})
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	sessionId, err := randomHex(32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	csrf, err := randomHex(32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	expiry := token.Expiry
+	if expiry.IsZero() {
+		expiry = time.Now().Add(time.Hour)
+	}
+	nsb.dashboards.Lock()
+	nsb.dashboards.forgetExpired()
+	nsb.dashboards.sessions[sessionId] = &dashboardSession{token: token.AccessToken, csrf: csrf, expiry: expiry}
+	nsb.dashboards.Unlock()
+	http.SetCookie(w, dashboardCookie(r, dashboardStateCookie, "", time.Unix(0, 0)))
+	http.SetCookie(w, dashboardCookie(r, dashboardSessionCookie, sessionId, expiry))
+	http.Redirect(w, r, login.next, http.StatusFound)
+}
+
+func (nsb *NginxDataflowServiceBroker) dashboardLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(dashboardSessionCookie); err == nil {
+		nsb.dashboards.Lock()
+		delete(nsb.dashboards.sessions, cookie.Value)
+		nsb.dashboards.Unlock()
+	}
+	http.SetCookie(w, dashboardCookie(r, dashboardSessionCookie, "", time.Unix(0, 0)))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("signed out\n"))
+}
+
+func (nsb *NginxDataflowServiceBroker) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	session := nsb.dashboardSession(r)
+	if session == nil {
+		nsb.signIn(w, r, "/dashboard")
+		return
+	}
+	//the service instances the user can see in the cloud controller, among the ones the broker stores
+	planIds := make([]string, 0)
+	for _, service := range nsb.config.Services {
+		for _, plan := range service.Plans {
+			planIds = append(planIds, plan.Id)
+		}
+	}
+	permissions, err := cfClient.GetVisibleServiceInstancesWorkflow(planIds, session.token, nsb.logger)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	instanceIds, err := nsb.databaseClient.ListServiceInstanceIds()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	instances := make([]dashboardInstance, 0)
+	for _, instanceID := range instanceIds {
+		permission, ok := permissions[instanceID]
+		if !ok {
+			continue
+		}
+		ns, err := nsb.databaseClient.GetServiceInstance(instanceID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		instances = append(instances, dashboardInstance{
+			Id:       instanceID,
+			Routes:   ns.AllRoutes(),
+			Bindings: len(ns.Nginxs),
+			Manage:   permission.Manage,
+		})
+	}
+	renderDashboard(w, dashboardListTemplate, instances)
+}
+
+func (nsb *NginxDataflowServiceBroker) dashboardInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["instance_id"]
+	session, permission, ok := nsb.dashboardAuthorize(w, r, instanceID)
+	if !ok {
+		return
+	}
+	nsb.renderDashboardInstance(w, instanceID, session, permission, "", "")
+}
+
+func (nsb *NginxDataflowServiceBroker) dashboardWeightsHandler(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["instance_id"]
+	session, permission, ok := nsb.dashboardAuthorizeManage(w, r, instanceID)
+	if !ok {
+		return
+	}
+	weights := make(map[string]int)
+	for field, values := range r.PostForm {
+		if !strings.HasPrefix(field, "weight-") || len(values) == 0 {
+			continue
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(values[0]))
+		if err != nil {
+			nsb.renderDashboardInstance(w, instanceID, session, permission, "", fmt.Sprintf("weight %q is not a number", values[0]))
+			return
+		}
+		weights[strings.TrimPrefix(field, "weight-")] = weight
+	}
+	if err := nsb.UpdateWeights(instanceID, weights); err != nil {
+		nsb.renderDashboardInstance(w, instanceID, session, permission, "", err.Error())
+		return
+	}
+	nsb.renderDashboardInstance(w, instanceID, session, permission, "the weights are deployed", "")
+}
+
+func (nsb *NginxDataflowServiceBroker) dashboardRedeployHandler(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["instance_id"]
+	session, permission, ok := nsb.dashboardAuthorizeManage(w, r, instanceID)
+	if !ok {
+		return
+	}
+	if err := nsb.redeploy(instanceID, deployRedeploy); err != nil {
+		nsb.renderDashboardInstance(w, instanceID, session, permission, "", err.Error())
+		return
+	}
+	nsb.renderDashboardInstance(w, instanceID, session, permission, "the nginx application is redeployed", "")
+}
+
+// dashboardAuthorize signs the user in and checks the user may see the service instance
+func (nsb *NginxDataflowServiceBroker) dashboardAuthorize(w http.ResponseWriter, r *http.Request, instanceID string) (*dashboardSession, cfClient.ServiceInstancePermissions, bool) {
+	session := nsb.dashboardSession(r)
+	if session == nil {
+		if r.Method != http.MethodGet {
+			http.Error(w, "the session expired, sign in again", http.StatusUnauthorized)
+			return nil, cfClient.ServiceInstancePermissions{}, false
+		}
+		nsb.signIn(w, r, "/dashboard/instances/" + url.PathEscape(instanceID))
+		return nil, cfClient.ServiceInstancePermissions{}, false
+	}
+	permissions, err := cfClient.GetServiceInstancesPermissionsWorkflow([]string{instanceID}, session.token, nsb.logger)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, cfClient.ServiceInstancePermissions{}, false
+	}
+	permission, ok := permissions[instanceID]
+	if !ok {
+		http.Error(w, "service instance not found", http.StatusNotFound)
+		return nil, cfClient.ServiceInstancePermissions{}, false
+	}
+	return session, permission, true
+}
+
+// dashboardAuthorizeManage also checks the user may manage the service instance and the form comes from the dashboard
+func (nsb *NginxDataflowServiceBroker) dashboardAuthorizeManage(w http.ResponseWriter, r *http.Request, instanceID string) (*dashboardSession, cfClient.ServiceInstancePermissions, bool) {
+	session, permission, ok := nsb.dashboardAuthorize(w, r, instanceID)
+	if !ok {
+		return nil, permission, false
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("csrf") != session.csrf {
+		http.Error(w, "invalid form", http.StatusForbidden)
+		return nil, permission, false
+	}
+	if !permission.Manage {
+		http.Error(w, "only space developers manage the service instance", http.StatusForbidden)
+		return nil, permission, false
+	}
+	return session, permission, true
+}
+
+func (nsb *NginxDataflowServiceBroker) renderDashboardInstance(w http.ResponseWriter, instanceID string, session *dashboardSession, permission cfClient.ServiceInstancePermissions, message, errMessage string) {
+	exist, err := nsb.databaseClient.ExistServiceInstance(instanceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if exist == false {
+		http.Error(w, brokerapi.ErrInstanceDoesNotExist.Error(), http.StatusNotFound)
+		return
+	}
+	ns, err := nsb.databaseClient.GetServiceInstance(instanceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ns.ServiceId = instanceID
+	plan, err := nsb.instancePlan(instanceID, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deployments, err := nsb.databaseClient.ListDeployments(instanceID, dashboardHistoryLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := dashboardInstancePage{
+		Id:          instanceID,
+		Plan:        plan.Name,
+		Routes:      ns.AllRoutes(),
+		Maintenance: ns.Maintenance,
+		Nginxs:      ns.Nginxs,
+		Deployments: deployments,
+		Manage:      permission.Manage,
+		Csrf:        session.csrf,
+		Message:     message,
+		Error:       errMessage,
+	}
+	sort.Slice(page.Nginxs, func(i, j int) bool {
+		return page.Nginxs[i].Port < page.Nginxs[j].Port
+	})
+	//the config shows the secret status path, which only the space developers see
+	if permission.Manage {
+		ns.Resolver = nsb.config.InternalResolver
+		ns.TrustedProxies = nsb.config.TrustedProxies
+		var config strings.Builder
+		if err := route.RenderNginxTemplate(nsb.config.TemplateDir + "nginx.conf.templ", ns, &config); err != nil {
+			page.Config = "render nginx config err: " + err.Error()
+		} else {
+			page.Config = config.String()
+		}
+	}
+	renderDashboard(w, dashboardInstanceTemplate, page)
+}
+
+// UpdateWeights sets the weights of the balanced bindings named in weights and redeploys the nginx application
+func (nsb *NginxDataflowServiceBroker) UpdateWeights(instanceID string, weights map[string]int) error {
+	nsb.logger.Debug("update-service-instance-weights", lager.Data{
+		"instance_id":        	instanceID,
+		"weights":		weights,
+	})
+	unlock := nsb.lockInstance(instanceID)
+	defer unlock()
+
+	exist, err := nsb.databaseClient.ExistServiceInstance(instanceID)
+	if err != nil {
+		return err
+	}
+	if exist == false {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+	plan, err := nsb.instancePlan(instanceID, "")
+	if err != nil {
+		return err
+	}
+	ns, err := nsb.databaseClient.GetServiceInstance(instanceID)
+	if err != nil {
+		return err
+	}
+	ns.ServiceId = instanceID
+	changed := false
+	for name, weight := range weights {
+		found := false
+		for i, n := range ns.Nginxs {
+			if n.Name != name {
+				continue
+			}
+			found = true
+			if n.Mirror() {
+				return fmt.Errorf("the mirror binding %s has no weight", name)
+			}
+			if weight < 1 {
+				return fmt.Errorf("the weight of binding %s must be at least 1", name)
+			}
+			if n.Weight != weight {
+				ns.Nginxs[i].Weight = weight
+				changed = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("binding %s not found", name)
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if err := nsb.deploy(instanceID, plan, ns, deployWeights); err != nil {
+		return err
+	}
+	serviceDetails, err := json.Marshal(ns)
+	if err != nil {
+		return err
+	}
+	return nsb.databaseClient.UpdateServiceInstance(instanceID, serviceDetails)
+}
+
+func dashboardCookie(r *http.Request, name, value string, expiry time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/dashboard",
+		Expires:  expiry,
+		HttpOnly: true,
+		Secure:   r.URL.Scheme == "https" || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func randomHex(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func renderDashboard(w http.ResponseWriter, page *template.Template, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := page.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+const dashboardLayout = `{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>nginx flow dashboard</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+pre { background: #f4f4f4; padding: 1em; overflow: auto; }
+.message { color: #1a7f37; }
+.error { color: #cf222e; }
+input[type=number] { width: 5em; }
+</style>
+</head>
+<body>
+<p><a href="/dashboard">service instances</a> | <a href="/dashboard/logout">sign out</a></p>
+{{end}}`
+
+var dashboardListTemplate = template.Must(template.Must(template.New("list").Parse(dashboardLayout)).Parse(`{{template "head"}}
+<h1>Service instances</h1>
+{{if .}}<table>
+<tr><th>service instance</th><th>routes</th><th>bindings</th><th>access</th></tr>
+{{range .}}<tr>
+<td><a href="/dashboard/instances/{{.Id}}">{{.Id}}</a></td>
+<td>{{range .Routes}}{{.Host}}.{{.Domain}}{{.Path}}<br>{{end}}</td>
+<td>{{.Bindings}}</td>
+<td>{{if .Manage}}manage{{else}}read{{end}}</td>
+</tr>{{end}}
+</table>{{else}}<p>You have no service instance.</p>{{end}}
+</body>
+</html>
+`))
+
+var dashboardInstanceTemplate = template.Must(template.Must(template.New("instance").Parse(dashboardLayout)).Parse(`{{template "head"}}
+<h1>Service instance {{.Id}}</h1>
+{{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<p>plan {{.Plan}}{{if .Maintenance}}, in maintenance{{end}}</p>
+<h2>Routes</h2>
+<ul>{{range .Routes}}<li>{{.Host}}.{{.Domain}}{{.Path}}</li>{{end}}</ul>
+<h2>Bindings</h2>
+{{if .Nginxs}}<form method="post" action="/dashboard/instances/{{.Id}}/weights">
+<input type="hidden" name="csrf" value="{{.Csrf}}">
+<table>
+<tr><th>binding</th><th>url</th><th>protocol</th><th>role</th><th>weight</th></tr>
+{{$manage := .Manage}}{{range .Nginxs}}<tr>
+<td>{{.Name}}</td>
+<td>{{.Url}}</td>
+<td>{{or .Protocol "http"}}</td>
+<td>{{if .Mirror}}mirror {{or .MirrorPercent 100}}%{{end}}</td>
+<td>{{if .Mirror}}-{{else if $manage}}<input type="number" min="1" name="weight-{{.Name}}" value="{{.Weight}}">{{else}}{{.Weight}}{{end}}</td>
+</tr>{{end}}
+</table>
+{{if .Manage}}<button type="submit">deploy the weights</button>{{end}}
+</form>{{else}}<p>No application is bound.</p>{{end}}
+{{if .Manage}}<form method="post" action="/dashboard/instances/{{.Id}}/redeploy">
+<input type="hidden" name="csrf" value="{{.Csrf}}">
+<p><button type="submit">redeploy the nginx application</button></p>
+</form>{{end}}
+<h2>Deployments</h2>
+{{if .Deployments}}<table>
+<tr><th>time</th><th>operation</th></tr>
+{{range .Deployments}}<tr><td>{{.CreatedAt.UTC.Format "2006-01-02 15:04:05 UTC"}}</td><td>{{.Operation}}</td></tr>{{end}}
+</table>{{else}}<p>No deployment recorded.</p>{{end}}
+{{if .Manage}}<h2>nginx.conf</h2>
+<pre>{{.Config}}</pre>{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,164 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/wdxxs2z/nginx-flow-osb/db"
+	cfClient "github.com/wdxxs2z/nginx-flow-osb/client"
+)
+
+//the operations pushing the nginx application, kept in the deployment history
+const (
+	deployProvision  = "provision"
+	deployUpdate     = "update"
+	deployMigrate    = "migrate"
+	deployBind       = "bind"
+	deployUnbind     = "unbind"
+	deployPurgeCache = "purge-cache"
+	deployRedeploy   = "redeploy"
+	deployWeights    = "weights"
+	deployRollout    = "rollout"
+	deployRotate     = "rotate"
+	deployRollback   = "rollback"
+)
+
+const deploymentHistoryLimit = 50
+
+// DeploymentResponse is a push of the nginx application, Changes names what differs from the push before
+type DeploymentResponse struct {
+	Id               int64                          `json:"id"`
+	Operation        string                         `json:"operation"`
+	AppGuid          string                         `json:"app_guid,omitempty"`
+	DropletGuid      string                         `json:"droplet_guid,omitempty"`
+	TemplateChecksum string                         `json:"template_checksum,omitempty"`
+	ConfigHash       string                         `json:"config_hash,omitempty"`
+	CreatedAt        time.Time                      `json:"created_at"`
+	Changes          []string                       `json:"changes,omitempty"`
+}
+
+// recordDeployment only logs its failures, the push already happened
+func (nsb *NginxDataflowServiceBroker) recordDeployment(instanceID, operation, appGuid string) {
+	deployment := db.Deployment{
+		ServiceInstanceId: instanceID,
+		Operation:         operation,
+		AppGuid:           appGuid,
+		CreatedAt:         time.Now(),
+	}
+	var err error
+	if deployment.TemplateChecksum, err = nsb.templateChecksum(); err != nil {
+		nsb.logger.Error("record-deployment-template-checksum", err, lager.Data{"instance_id": instanceID})
+	}
+	if deployment.ConfigHash, err = fileChecksum(nsb.config.StoreDataDir + instanceID + "/nginx.conf"); err != nil {
+		nsb.logger.Error("record-deployment-config-hash", err, lager.Data{"instance_id": instanceID})
+	}
+	//a provision does not wait for the staging, its droplet is not known yet
+	if appGuid != "" {
+		if deployment.DropletGuid, err = cfClient.GetCurrentDropletWorkflow(appGuid, nsb.logger); err != nil {
+			nsb.logger.Error("record-deployment-droplet", err, lager.Data{"instance_id": instanceID})
+		}
+	}
+	if err := nsb.databaseClient.CreateDeployment(deployment); err != nil {
+		nsb.logger.Error("record-deployment", err, lager.Data{
+			"instance_id": instanceID,
+			"operation":   operation,
+		})
+	}
+}
+
+func (nsb *NginxDataflowServiceBroker) templateChecksum() (string, error) {
+	return fileChecksum(nsb.config.TemplateDir + "nginx.conf.templ")
+}
+
+// Deployments returns the last deployments of a service instance, the newest first
+func (nsb *NginxDataflowServiceBroker) Deployments(instanceID string) ([]DeploymentResponse, error) {
+	nsb.logger.Debug("service-instance-deployments", lager.Data{
+		"instance_id":        	instanceID,
+	})
+	exist, err := nsb.databaseClient.ExistServiceInstance(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if exist == false {
+		return nil, brokerapi.ErrInstanceDoesNotExist
+	}
+	//one more to compare the oldest with
+	deployments, err := nsb.databaseClient.ListDeployments(instanceID, deploymentHistoryLimit + 1)
+	if err != nil {
+		return nil, err
+	}
+	responses := make([]DeploymentResponse, 0)
+	for i, deployment := range deployments {
+		if i == deploymentHistoryLimit {
+			break
+		}
+		response := deploymentResponse(deployment)
+		if i + 1 < len(deployments) {
+			response.Changes = deploymentChanges(deployments[i + 1], deployment)
+		}
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
+
+func deploymentResponse(deployment db.Deployment) DeploymentResponse {
+	return DeploymentResponse{
+		Id:               deployment.Id,
+		Operation:        deployment.Operation,
+		AppGuid:          deployment.AppGuid,
+		DropletGuid:      deployment.DropletGuid,
+		TemplateChecksum: deployment.TemplateChecksum,
+		ConfigHash:       deployment.ConfigHash,
+		CreatedAt:        deployment.CreatedAt,
+	}
+}
+
+//the values not recorded, like the droplet of a provision, are not compared
+func deploymentChanges(previous, deployment db.Deployment) []string {
+	changes := make([]string, 0)
+	if previous.TemplateChecksum != "" && deployment.TemplateChecksum != "" && previous.TemplateChecksum != deployment.TemplateChecksum {
+		changes = append(changes, "template")
+	}
+	if previous.ConfigHash != "" && deployment.ConfigHash != "" && previous.ConfigHash != deployment.ConfigHash {
+		changes = append(changes, "config")
+	}
+	if previous.DropletGuid != "" && deployment.DropletGuid != "" && previous.DropletGuid != deployment.DropletGuid {
+		changes = append(changes, "droplet")
+	}
+	return changes
+}
+
+// staleDeployment tells whether the last deployment used another template, or none was recorded
+func staleDeployment(deployments []db.Deployment, templateChecksum string) bool {
+	return len(deployments) == 0 || deployments[0].TemplateChecksum != templateChecksum
+}
+
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (nsb *NginxDataflowServiceBroker) deploymentsHandler(w http.ResponseWriter, r *http.Request) {
+	deployments, err := nsb.Deployments(mux.Vars(r)["instance_id"])
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	respond(w, http.StatusOK, deployments)
+}
@@ -0,0 +1,68 @@
+package broker
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/wdxxs2z/nginx-flow-osb/route"
+)
+
+//the tenants give the urls, the dialer only connects to public addresses after the dns resolution
+var errorPageClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		Proxy:       nil,
+		DialContext: (&net.Dialer{Timeout: 10 * time.Second, Control: publicAddressOnly}).DialContext,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+//carrier-grade nat, not covered by net.IP.IsPrivate
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func publicAddressOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("error page address %s is not public", host)
+	}
+	return nil
+}
+
+// fetchErrorPages keeps a copy of the pages given by url, a redirect fails the fetch
+func fetchErrorPages(pages map[string]route.ErrorPage) error {
+	for status, page := range pages {
+		if page.Url == "" {
+			continue
+		}
+		resp, err := errorPageClient.Get(page.Url)
+		if err != nil {
+			return fmt.Errorf("fetch error page %s err: %s", status, err)
+		}
+		html, err := ioutil.ReadAll(io.LimitReader(resp.Body, route.MaxErrorPageSize + 1))
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("fetch error page %s err: %s", status, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("fetch error page %s from %s returned %d", status, page.Url, resp.StatusCode)
+		}
+		if len(html) > route.MaxErrorPageSize {
+			return fmt.Errorf("error page %s exceeds %d bytes", status, route.MaxErrorPageSize)
+		}
+		page.Html = string(html)
+		pages[status] = page
+	}
+	return nil
+}
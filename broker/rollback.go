@@ -0,0 +1,179 @@
+package broker
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/wdxxs2z/nginx-flow-osb/config"
+	"github.com/wdxxs2z/nginx-flow-osb/route"
+)
+
+const revisionHistoryLimit = 50
+
+// RevisionResponse is a stored version of a service instance, the newest revision is the current one
+type RevisionResponse struct {
+	Revision         int                            `json:"revision"`
+	CreatedAt        time.Time                      `json:"created_at"`
+	Bindings         int                            `json:"bindings"`
+	ServiceInstance  route.NginxService             `json:"service_instance"`
+}
+
+type RollbackRequest struct {
+	Revision         int                            `json:"revision"`
+}
+
+// Revisions returns the last revisions of a service instance, the newest first
+func (nsb *NginxDataflowServiceBroker) Revisions(instanceID string) ([]RevisionResponse, error) {
+	nsb.logger.Debug("service-instance-revisions", lager.Data{
+		"instance_id":        	instanceID,
+	})
+	exist, err := nsb.databaseClient.ExistServiceInstance(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if exist == false {
+		return nil, brokerapi.ErrInstanceDoesNotExist
+	}
+	revisions, err := nsb.databaseClient.ListRevisions(instanceID, revisionHistoryLimit)
+	if err != nil {
+		return nil, err
+	}
+	responses := make([]RevisionResponse, 0)
+	for _, revision := range revisions {
+		responses = append(responses, RevisionResponse{
+			Revision:        revision.Revision,
+			CreatedAt:       revision.CreatedAt,
+			Bindings:        len(revision.NginxService.Nginxs),
+			ServiceInstance: revision.NginxService,
+		})
+	}
+	return responses, nil
+}
+
+// Rollback restores a service instance to one of its revisions and redeploys it
+func (nsb *NginxDataflowServiceBroker) Rollback(instanceID string, revision int) error {
+	if err := nsb.checkReconciler(); err != nil {
+		return err
+	}
+	unlock := nsb.lockInstance(instanceID)
+	defer unlock()
+
+	exist, err := nsb.databaseClient.ExistServiceInstance(instanceID)
+	if err != nil {
+		return err
+	}
+	if exist == false {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+	plan, err := nsb.instancePlan(instanceID, "")
+	if err != nil {
+		return err
+	}
+	return nsb.rollback(instanceID, plan, revision)
+}
+
+// rollback saves the revision as a new one, so a rollback can be rolled back. The caller holds the instance lock
+func (nsb *NginxDataflowServiceBroker) rollback(instanceID string, plan config.Plan, revision int) error {
+	nsb.logger.Debug("rollback", lager.Data{
+		"instance_id":        	instanceID,
+		"revision":		revision,
+	})
+	stored, err := nsb.databaseClient.GetRevision(instanceID, revision)
+	if err == sql.ErrNoRows {
+		return brokerapi.NewFailureResponse(fmt.Errorf("service instance (%s) has no revision %d", instanceID, revision), http.StatusUnprocessableEntity, "rollback-revision")
+	}
+	if err != nil {
+		return err
+	}
+	current, err := nsb.databaseClient.GetServiceInstance(instanceID)
+	if err != nil {
+		return err
+	}
+	ns := nsb.restoreRevision(current, stored.NginxService)
+	ns.ServiceId = instanceID
+	if err := checkPlan(plan, ns); err != nil {
+		return err
+	}
+	spaceGuid, err := nsb.databaseClient.GetSpaceWithServiceId(instanceID)
+	if err != nil {
+		return err
+	}
+	if err := nsb.reserveTcpRoute(&ns, spaceGuid); err != nil {
+		return err
+	}
+	if err := nsb.deploy(instanceID, plan, ns, deployRollback); err != nil {
+		return err
+	}
+	serviceDetails, err := json.Marshal(ns)
+	if err != nil {
+		return err
+	}
+	return nsb.databaseClient.UpdateServiceInstance(instanceID, serviceDetails)
+}
+
+// restoreRevision keeps the bindings the platform changed since, a binding bound since moves off a reused port
+func (nsb *NginxDataflowServiceBroker) restoreRevision(current, revision route.NginxService) route.NginxService {
+	currentNames := make(map[string]bool)
+	for _, n := range current.Nginxs {
+		currentNames[n.Name] = true
+	}
+	nginxs := make([]route.Nginx, 0)
+	revisionNames := make(map[string]bool)
+	for _, n := range revision.Nginxs {
+		revisionNames[n.Name] = true
+		//only the bindings have an application, the nginxs parameter entries are restored as they were
+		if n.AppGuid != "" && !currentNames[n.Name] {
+			continue
+		}
+		nginxs = append(nginxs, n)
+	}
+	revision.Nginxs = nginxs
+	for _, n := range current.Nginxs {
+		if n.AppGuid == "" || revisionNames[n.Name] {
+			continue
+		}
+		for _, restored := range revision.Nginxs {
+			if restored.Port == n.Port {
+				n.Port = nsb.backendPort(revision)
+				break
+			}
+		}
+		revision.Nginxs = append(revision.Nginxs, n)
+	}
+	//the operator rotations, the reserved tcp port and the status path are not rolled back
+	revision.Stack = current.Stack
+	revision.Buildpack = current.Buildpack
+	revision.RotatedPlanBuildpack = current.RotatedPlanBuildpack
+	revision.TcpRoute = current.TcpRoute
+	revision.StatusPath = current.StatusPath
+	return revision
+}
+
+func (nsb *NginxDataflowServiceBroker) revisionsHandler(w http.ResponseWriter, r *http.Request) {
+	revisions, err := nsb.Revisions(mux.Vars(r)["instance_id"])
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	respond(w, http.StatusOK, revisions)
+}
+
+func (nsb *NginxDataflowServiceBroker) rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	var request RollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		respond(w, http.StatusBadRequest, brokerapi.ErrorResponse{Description: err.Error()})
+		return
+	}
+	if err := nsb.Rollback(mux.Vars(r)["instance_id"], request.Revision); err != nil {
+		respondError(w, err)
+		return
+	}
+	respond(w, http.StatusOK, brokerapi.EmptyResponse{})
+}
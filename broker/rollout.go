@@ -0,0 +1,450 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"encoding/json"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+
+	cfClient "github.com/wdxxs2z/nginx-flow-osb/client"
+)
+
+var ErrRolloutInProgress = brokerapi.NewFailureResponseBuilder(
+	errors.New("a rollout is in progress, cancel it or retry when it finished"), http.StatusConflict, "rollout-in-progress",
+).WithErrorKey("ConcurrencyError").Build()
+
+var ErrNoRollout = brokerapi.NewFailureResponseBuilder(
+	errors.New("no rollout started"), http.StatusNotFound, "no-rollout",
+).Build()
+
+var ErrRotationEmpty = brokerapi.NewFailureResponseBuilder(
+	errors.New("the rotation needs a stack or a buildpack"), http.StatusBadRequest, "rotation-empty",
+).Build()
+
+//the broker state key of the last rollout
+const rolloutStateKey = "rollout"
+
+// RolloutRequest deploys the Canary service instances first, a Buildpack holds until the plan buildpack changes
+type RolloutRequest struct {
+	Concurrency      int                            `json:"concurrency"`
+	Canary           int                            `json:"canary"`
+	PauseAfterCanary bool                           `json:"pause_after_canary"`
+	Stack            string                         `json:"stack"`
+	Buildpack        string                         `json:"buildpack"`
+}
+
+// RotationRequest is a rollout with a concurrency of 1 and no canary
+type RotationRequest struct {
+	Stack            string                         `json:"stack"`
+	Buildpack        string                         `json:"buildpack"`
+}
+
+// Rollout is saved in the database, a failed deploy or a broker restart pauses it
+type Rollout struct {
+	RolloutRequest
+	State            string                         `json:"state"`
+	Reason           string                         `json:"reason,omitempty"`
+	StartedAt        time.Time                      `json:"started_at"`
+	FinishedAt       *time.Time                     `json:"finished_at,omitempty"`
+	Progress         RolloutProgress                `json:"progress"`
+	Instances        []RolloutInstance              `json:"instances"`
+	next             int
+	running          int
+	canaryChecked    bool
+	wake             chan struct{}
+}
+
+type RolloutProgress struct {
+	Total            int                            `json:"total"`
+	Pending          int                            `json:"pending"`
+	Deploying        int                            `json:"deploying"`
+	Deployed         int                            `json:"deployed"`
+	Skipped          int                            `json:"skipped"`
+	Failed           int                            `json:"failed"`
+}
+
+type RolloutInstance struct {
+	InstanceId       string                         `json:"instance_id"`
+	Canary           bool                           `json:"canary,omitempty"`
+	State            string                         `json:"state"`
+	Error            string                         `json:"error,omitempty"`
+	StartedAt        *time.Time                     `json:"started_at,omitempty"`
+	FinishedAt       *time.Time                     `json:"finished_at,omitempty"`
+}
+
+const (
+	rolloutRunning   = "running"
+	rolloutPaused    = "paused"
+	rolloutCanceled  = "canceled"
+	rolloutSucceeded = "succeeded"
+	rolloutFailed    = "failed"
+)
+
+const (
+	instancePending   = "pending"
+	instanceDeploying = "deploying"
+	instanceDeployed  = "deployed"
+	instanceSkipped   = "skipped"
+	instanceFailed    = "failed"
+)
+
+// StartRollout starts a rollout over the service instances stored now
+func (nsb *NginxDataflowServiceBroker) StartRollout(request RolloutRequest) (Rollout, error) {
+	nsb.logger.Debug("admin-start-rollout", lager.Data{
+		"concurrency":	request.Concurrency,
+		"canary":	request.Canary,
+		"stack":	request.Stack,
+		"buildpack":	request.Buildpack,
+	})
+	if request.Concurrency < 0 || request.Canary < 0 {
+		return Rollout{}, brokerapi.NewFailureResponse(fmt.Errorf("rollout concurrency and canary must not be negative"), http.StatusBadRequest, "rollout-request")
+	}
+	if request.Concurrency == 0 {
+		request.Concurrency = 1
+	}
+	if request.Stack != "" {
+		if _, err := cfClient.GetStackWorkflow(request.Stack, nsb.logger); err != nil {
+			return Rollout{}, brokerapi.NewFailureResponse(err, http.StatusUnprocessableEntity, "rollout-stack")
+		}
+	}
+	nsb.rolloutMutex.Lock()
+	defer nsb.rolloutMutex.Unlock()
+	if nsb.rollout != nil && nsb.rollout.FinishedAt == nil {
+		return Rollout{}, ErrRolloutInProgress
+	}
+	instanceIds, err := nsb.databaseClient.ListServiceInstanceIds()
+	if err != nil {
+		return Rollout{}, err
+	}
+	rollout := &Rollout{
+		RolloutRequest: request,
+		State:          rolloutRunning,
+		StartedAt:      time.Now(),
+		Instances:      make([]RolloutInstance, 0),
+		wake:           make(chan struct{}, 1),
+	}
+	if nsb.reconciler.Paused {
+		rollout.State = rolloutPaused
+		rollout.Reason = reconcilerPausedReason
+	}
+	for index, instanceID := range instanceIds {
+		rollout.Instances = append(rollout.Instances, RolloutInstance{
+			InstanceId: instanceID,
+			Canary:     index < request.Canary,
+			State:      instancePending,
+		})
+	}
+	nsb.rollout = rollout
+	nsb.saveRollout(rollout)
+	go nsb.runRollout(rollout)
+	return rollout.copy(), nil
+}
+
+// StartRotation starts the rollout rotating the stack or the buildpack of every service instance
+func (nsb *NginxDataflowServiceBroker) StartRotation(request RotationRequest) (Rollout, error) {
+	if request.Stack == "" && request.Buildpack == "" {
+		return Rollout{}, ErrRotationEmpty
+	}
+	return nsb.StartRollout(RolloutRequest{
+		Concurrency: 1,
+		Stack:       request.Stack,
+		Buildpack:   request.Buildpack,
+	})
+}
+
+// LastRollout returns the rollout in progress or the last one
+func (nsb *NginxDataflowServiceBroker) LastRollout() (Rollout, error) {
+	nsb.rolloutMutex.Lock()
+	defer nsb.rolloutMutex.Unlock()
+	if nsb.rollout == nil {
+		return Rollout{}, ErrNoRollout
+	}
+	return nsb.rollout.copy(), nil
+}
+
+// PauseRollout lets the deploys in progress finish and starts no other
+func (nsb *NginxDataflowServiceBroker) PauseRollout() (Rollout, error) {
+	return nsb.changeRollout(rolloutRunning, rolloutPaused, "paused by the operator")
+}
+
+// ResumeRollout goes on with the pending service instances, the failed ones are not retried
+func (nsb *NginxDataflowServiceBroker) ResumeRollout() (Rollout, error) {
+	return nsb.changeRollout(rolloutPaused, rolloutRunning, "")
+}
+
+// CancelRollout leaves the pending service instances on their current deploy
+func (nsb *NginxDataflowServiceBroker) CancelRollout() (Rollout, error) {
+	return nsb.changeRollout("", rolloutCanceled, "canceled by the operator")
+}
+
+// changeRollout moves a rollout not finished from the state from, any state when empty, to the state to
+func (nsb *NginxDataflowServiceBroker) changeRollout(from, to, reason string) (Rollout, error) {
+	nsb.rolloutMutex.Lock()
+	defer nsb.rolloutMutex.Unlock()
+	rollout := nsb.rollout
+	if rollout == nil {
+		return Rollout{}, ErrNoRollout
+	}
+	if rollout.FinishedAt != nil || (from != "" && rollout.State != from) {
+		return Rollout{}, brokerapi.NewFailureResponse(fmt.Errorf("the rollout is %s", rollout.State), http.StatusConflict, "rollout-state")
+	}
+	if to == rolloutRunning && nsb.reconciler.Paused {
+		return Rollout{}, ErrReconcilerPaused
+	}
+	rollout.State = to
+	rollout.Reason = reason
+	nsb.saveRollout(rollout)
+	rollout.signal()
+	return rollout.copy(), nil
+}
+
+// signal wakes the coordinator of the rollout up after a change of its state
+func (r *Rollout) signal() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+type rolloutResult struct {
+	index            int
+	deployed         bool
+	err              error
+}
+
+// runRollout starts the deploys and waits for their results or a change by the operator
+func (nsb *NginxDataflowServiceBroker) runRollout(rollout *Rollout) {
+	results := make(chan rolloutResult)
+	for {
+		nsb.rolloutMutex.Lock()
+		for rollout.State == rolloutRunning && rollout.next < len(rollout.Instances) && rollout.running < rollout.Concurrency {
+			//the canary service instances are all deployed before the others start
+			if rollout.next == rollout.Canary && rollout.Canary > 0 && !rollout.canaryChecked {
+				if rollout.running > 0 {
+					break
+				}
+				rollout.canaryChecked = true
+				if rollout.PauseAfterCanary {
+					rollout.State = rolloutPaused
+					rollout.Reason = "the canary service instances are deployed"
+					break
+				}
+			}
+			index := rollout.next
+			started := time.Now()
+			rollout.Instances[index].State = instanceDeploying
+			rollout.Instances[index].StartedAt = &started
+			rollout.next++
+			rollout.running++
+			go func(index int, instanceID string) {
+				deployed, err := nsb.redeployInstance(instanceID, rollout.Stack, rollout.Buildpack)
+				results <- rolloutResult{index: index, deployed: deployed, err: err}
+			}(index, rollout.Instances[index].InstanceId)
+		}
+		if rollout.running == 0 && (rollout.State == rolloutCanceled || (rollout.State == rolloutRunning && rollout.next == len(rollout.Instances))) {
+			nsb.finishRollout(rollout)
+			nsb.saveRollout(rollout)
+			nsb.rolloutMutex.Unlock()
+			return
+		}
+		nsb.saveRollout(rollout)
+		nsb.rolloutMutex.Unlock()
+
+		select {
+		case result := <-results:
+			nsb.rolloutMutex.Lock()
+			finished := time.Now()
+			instance := &rollout.Instances[result.index]
+			instance.FinishedAt = &finished
+			rollout.running--
+			switch {
+			case result.err != nil:
+				nsb.logger.Error("admin-rollout-instance", result.err, lager.Data{"instance_id": instance.InstanceId})
+				instance.State = instanceFailed
+				instance.Error = result.err.Error()
+				if rollout.State == rolloutRunning {
+					rollout.State = rolloutPaused
+					rollout.Reason = fmt.Sprintf("the deploy of service instance %s failed", instance.InstanceId)
+				}
+			case result.deployed:
+				instance.State = instanceDeployed
+			default:
+				instance.State = instanceSkipped
+			}
+			nsb.saveRollout(rollout)
+			nsb.rolloutMutex.Unlock()
+		case <-rollout.wake:
+		}
+	}
+}
+
+// finishRollout is called with the rollout lock held
+func (nsb *NginxDataflowServiceBroker) finishRollout(rollout *Rollout) {
+	finished := time.Now()
+	rollout.FinishedAt = &finished
+	if rollout.State == rolloutCanceled {
+		return
+	}
+	rollout.State = rolloutSucceeded
+	for _, instance := range rollout.Instances {
+		if instance.State == instanceFailed {
+			rollout.State = rolloutFailed
+			break
+		}
+	}
+}
+
+// saveRollout is called with the rollout lock held, the rollout goes on when it cannot be saved
+func (nsb *NginxDataflowServiceBroker) saveRollout(rollout *Rollout) {
+	details, err := json.Marshal(rollout.copy())
+	if err == nil {
+		err = nsb.databaseClient.SaveBrokerState(rolloutStateKey, details)
+	}
+	if err != nil {
+		nsb.logger.Error("admin-save-rollout", err, lager.Data{"state": rollout.State})
+	}
+}
+
+// restoreRollout pauses the rollout the broker stopped during and fails its deploys in progress
+func (nsb *NginxDataflowServiceBroker) restoreRollout() error {
+	details, err := nsb.databaseClient.GetBrokerState(rolloutStateKey)
+	if err != nil || details == nil {
+		return err
+	}
+	rollout := &Rollout{}
+	if err := json.Unmarshal(details, rollout); err != nil {
+		return err
+	}
+	nsb.rolloutMutex.Lock()
+	defer nsb.rolloutMutex.Unlock()
+	nsb.rollout = rollout
+	if rollout.FinishedAt != nil {
+		return nil
+	}
+	rollout.next = len(rollout.Instances)
+	for index := range rollout.Instances {
+		instance := &rollout.Instances[index]
+		if instance.State == instanceDeploying {
+			finished := time.Now()
+			instance.State = instanceFailed
+			instance.Error = "the broker restarted during the deploy"
+			instance.FinishedAt = &finished
+		}
+		if instance.State == instancePending && index < rollout.next {
+			rollout.next = index
+		}
+	}
+	//the canary service instances are finished, the operator resumes the rollout after them
+	rollout.canaryChecked = rollout.next >= rollout.Canary
+	if rollout.State != rolloutCanceled {
+		rollout.State = rolloutPaused
+		rollout.Reason = "the broker restarted during the rollout, resume or cancel it"
+	}
+	rollout.wake = make(chan struct{}, 1)
+	nsb.saveRollout(rollout)
+	go nsb.runRollout(rollout)
+	return nil
+}
+
+// redeployInstance skips the service instances deleted since the start of the rollout
+func (nsb *NginxDataflowServiceBroker) redeployInstance(instanceID, stack, buildpack string) (bool, error) {
+	unlock := nsb.lockInstance(instanceID)
+	defer unlock()
+
+	exist, err := nsb.databaseClient.ExistServiceInstance(instanceID)
+	if err != nil || exist == false {
+		return false, err
+	}
+	plan, err := nsb.instancePlan(instanceID, "")
+	if err != nil {
+		return false, err
+	}
+	ns, err := nsb.databaseClient.GetServiceInstance(instanceID)
+	if err != nil {
+		return false, err
+	}
+	ns.ServiceId = instanceID
+	if stack != "" {
+		ns.Stack = stack
+	}
+	if buildpack != "" {
+		ns.Buildpack = buildpack
+		ns.RotatedPlanBuildpack = plan.InstanceConfig.Buildpack
+	}
+	operation := deployRollout
+	if stack != "" || buildpack != "" {
+		operation = deployRotate
+	}
+	if err := nsb.deploy(instanceID, plan, ns, operation); err != nil {
+		return false, err
+	}
+	serviceDetails, err := json.Marshal(ns)
+	if err != nil {
+		return false, err
+	}
+	return true, nsb.databaseClient.UpdateServiceInstance(instanceID, serviceDetails)
+}
+
+func (r *Rollout) copy() Rollout {
+	rollout := *r
+	rollout.Instances = append([]RolloutInstance{}, r.Instances...)
+	rollout.Progress = RolloutProgress{Total: len(r.Instances)}
+	for _, instance := range r.Instances {
+		switch instance.State {
+		case instancePending:
+			rollout.Progress.Pending++
+		case instanceDeploying:
+			rollout.Progress.Deploying++
+		case instanceDeployed:
+			rollout.Progress.Deployed++
+		case instanceSkipped:
+			rollout.Progress.Skipped++
+		case instanceFailed:
+			rollout.Progress.Failed++
+		}
+	}
+	return rollout
+}
+
+func (nsb *NginxDataflowServiceBroker) startRolloutHandler(w http.ResponseWriter, r *http.Request) {
+	var request RolloutRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		respond(w, http.StatusBadRequest, brokerapi.ErrorResponse{Description: err.Error()})
+		return
+	}
+	rollout, err := nsb.StartRollout(request)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	respond(w, http.StatusAccepted, rollout)
+}
+
+func (nsb *NginxDataflowServiceBroker) startRotationHandler(w http.ResponseWriter, r *http.Request) {
+	var request RotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		respond(w, http.StatusBadRequest, brokerapi.ErrorResponse{Description: err.Error()})
+		return
+	}
+	rollout, err := nsb.StartRotation(request)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	respond(w, http.StatusAccepted, rollout)
+}
+
+func (nsb *NginxDataflowServiceBroker) rolloutHandler(change func() (Rollout, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rollout, err := change()
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		respond(w, http.StatusOK, rollout)
+	}
+}
@@ -0,0 +1,353 @@
+package broker
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/wdxxs2z/nginx-flow-osb/route"
+	cfClient "github.com/wdxxs2z/nginx-flow-osb/client"
+)
+
+var ErrStatsUnavailable = brokerapi.NewFailureResponseBuilder(
+	errors.New("the service instance has no status path yet, update it to enable the statistics"), http.StatusUnprocessableEntity, "stats-unavailable",
+).Build()
+
+// InstanceStats counts the binding requests since the last deploy of the nginx application
+type InstanceStats struct {
+	InstanceId      string                          `json:"instance_id"`
+	AppInstances    []AppInstanceStats              `json:"app_instances"`
+	Bindings        []BindingStats                  `json:"bindings"`
+}
+
+// AppInstanceStats is the stub_status of one instance of the nginx application
+type AppInstanceStats struct {
+	Index             int                           `json:"index"`
+	ActiveConnections int64                         `json:"active_connections"`
+	Accepts           int64                         `json:"accepts"`
+	Handled           int64                         `json:"handled"`
+	Requests          int64                         `json:"requests"`
+	Error             string                        `json:"error,omitempty"`
+}
+
+// BindingStats compares the share of the requests a binding receives with the share of its weight
+type BindingStats struct {
+	Name                 string                     `json:"name"`
+	Url                  string                     `json:"url"`
+	Role                 string                     `json:"role,omitempty"`
+	Weight               int                        `json:"weight"`
+	WeightShare          float64                    `json:"weight_share"`
+	Requests             int64                      `json:"requests"`
+	RequestShare         float64                    `json:"request_share"`
+	Errors               int64                      `json:"errors"`
+	ErrorRate            float64                    `json:"error_rate"`
+	UpstreamResponseTime float64                    `json:"avg_upstream_response_time_ms"`
+}
+
+// instanceCounters has its own lock, the scrapes of other service instances do not wait
+type instanceCounters struct {
+	sync.Mutex
+	appInstances    map[string]*statsCounter
+}
+
+// statsCounter remembers the offset read, the next scrape reads only the new lines
+type statsCounter struct {
+	offset          int64
+	ports           map[int]*portCounter
+}
+
+type portCounter struct {
+	requests        int64
+	errors          int64
+	timed           int64
+	responseTime    float64
+}
+
+//the nginx applications use the certificates of the platform, which the cloud controller client does not check either
+var statsClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+}
+
+// Stats scrapes every application instance through the route with X-Cf-App-Instance
+func (nsb *NginxDataflowServiceBroker) Stats(instanceID string) (InstanceStats, error) {
+	nsb.logger.Debug("service-instance-stats", lager.Data{
+		"instance_id":        	instanceID,
+	})
+	exist, err := nsb.databaseClient.ExistServiceInstance(instanceID)
+	if err != nil {
+		return InstanceStats{}, err
+	}
+	if exist == false {
+		return InstanceStats{}, brokerapi.ErrInstanceDoesNotExist
+	}
+	ns, err := nsb.databaseClient.GetServiceInstance(instanceID)
+	if err != nil {
+		return InstanceStats{}, err
+	}
+	if ns.StatusPath == "" {
+		return InstanceStats{}, ErrStatsUnavailable
+	}
+	baseUrl := ""
+	for _, r := range ns.AllRoutes() {
+		if r.Path == "" {
+			baseUrl = "https://" + r.Host + "." + r.Domain + "/" + ns.StatusPath
+			break
+		}
+	}
+	if baseUrl == "" {
+		return InstanceStats{}, fmt.Errorf("service instance (%s) has no route without path to scrape", instanceID)
+	}
+	app, err := cfClient.GetApplicationWorkflow("nginx-flow-" + instanceID, nsb.logger)
+	if err != nil {
+		return InstanceStats{}, err
+	}
+	if app.Guid == "" {
+		return InstanceStats{}, fmt.Errorf("the nginx application of service instance (%s) not found", instanceID)
+	}
+	stats := InstanceStats{InstanceId: instanceID}
+	ports := make(map[int]*portCounter)
+	appInstances := make(map[string]bool)
+	counters := nsb.instanceCounters(instanceID)
+	counters.Lock()
+	defer counters.Unlock()
+	for index := 0; index < app.Instances; index++ {
+		appInstance := app.Guid + ":" + strconv.Itoa(index)
+		appInstances[appInstance] = true
+		instanceStats, err := scrapeStatus(baseUrl + "/status", appInstance)
+		instanceStats.Index = index
+		if err == nil {
+			err = scrapeStatsLog(counters, appInstance, baseUrl + "/stats.log", ports)
+		}
+		if err != nil {
+			instanceStats.Error = err.Error()
+		}
+		stats.AppInstances = append(stats.AppInstances, instanceStats)
+	}
+	//the counters of the application instances gone with a deploy or a scale down
+	for appInstance := range counters.appInstances {
+		if !appInstances[appInstance] {
+			delete(counters.appInstances, appInstance)
+		}
+	}
+	stats.Bindings = bindingStats(ns, ports)
+	return stats, nil
+}
+
+func scrapeStatus(statusUrl, appInstance string) (AppInstanceStats, error) {
+	request, err := http.NewRequest(http.MethodGet, statusUrl, nil)
+	if err != nil {
+		return AppInstanceStats{}, err
+	}
+	request.Header.Set("X-Cf-App-Instance", appInstance)
+	resp, err := statsClient.Do(request)
+	if err != nil {
+		return AppInstanceStats{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return AppInstanceStats{}, fmt.Errorf("status returned %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return AppInstanceStats{}, err
+	}
+	//Active connections: 2
+	//server accepts handled requests
+	// 10 10 20
+	fields := strings.Fields(string(body))
+	var values []int64
+	for _, index := range []int{2, 7, 8, 9} {
+		if index >= len(fields) {
+			return AppInstanceStats{}, fmt.Errorf("parse status err: %q", body)
+		}
+		value, err := strconv.ParseInt(fields[index], 10, 64)
+		if err != nil {
+			return AppInstanceStats{}, fmt.Errorf("parse status err: %s", err)
+		}
+		values = append(values, value)
+	}
+	return AppInstanceStats{
+		ActiveConnections: values[0],
+		Accepts:           values[1],
+		Handled:           values[2],
+		Requests:          values[3],
+	}, nil
+}
+
+func (nsb *NginxDataflowServiceBroker) instanceCounters(instanceID string) *instanceCounters {
+	nsb.statsMutex.Lock()
+	defer nsb.statsMutex.Unlock()
+	counters, ok := nsb.statsCounters[instanceID]
+	if !ok {
+		counters = &instanceCounters{appInstances: make(map[string]*statsCounter)}
+		nsb.statsCounters[instanceID] = counters
+	}
+	return counters
+}
+
+// scrapeStatsLog is called with the lock of the counters held
+func scrapeStatsLog(counters *instanceCounters, appInstance, logUrl string, ports map[int]*portCounter) error {
+	counter, ok := counters.appInstances[appInstance]
+	if !ok {
+		counter = &statsCounter{ports: make(map[int]*portCounter)}
+		counters.appInstances[appInstance] = counter
+	}
+	if err := readStatsLog(counter, appInstance, logUrl); err != nil {
+		return err
+	}
+	for port, c := range counter.ports {
+		total, ok := ports[port]
+		if !ok {
+			total = &portCounter{}
+			ports[port] = total
+		}
+		total.requests += c.requests
+		total.errors += c.errors
+		total.timed += c.timed
+		total.responseTime += c.responseTime
+	}
+	return nil
+}
+
+func readStatsLog(counter *statsCounter, appInstance, logUrl string) error {
+	request, err := http.NewRequest(http.MethodGet, logUrl, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("X-Cf-App-Instance", appInstance)
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-", counter.offset))
+	resp, err := statsClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		//the whole log, the application instance was restarted
+		counter.offset = 0
+		counter.ports = make(map[int]*portCounter)
+	case http.StatusRequestedRangeNotSatisfiable:
+		//a log smaller than the offset was truncated, it is read again from its start
+		var size int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes */%d", &size); err == nil && size < counter.offset {
+			counter.offset = 0
+			return readStatsLog(counter, appInstance, logUrl)
+		}
+	case http.StatusNotFound:
+		//no request since the start
+	default:
+		return fmt.Errorf("stats log returned %d", resp.StatusCode)
+	}
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		reader := bufio.NewReader(resp.Body)
+		for {
+			line, err := reader.ReadString('\n')
+			if err == io.EOF {
+				//a line nginx is still writing is read on the next scrape
+				break
+			}
+			if err != nil {
+				return err
+			}
+			counter.offset += int64(len(line))
+			countStatsLine(counter.ports, line)
+		}
+	}
+	return nil
+}
+
+//8001 200 0.012
+func countStatsLine(ports map[int]*portCounter, line string) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return
+	}
+	port, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return
+	}
+	status, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return
+	}
+	c, ok := ports[port]
+	if !ok {
+		c = &portCounter{}
+		ports[port] = c
+	}
+	c.requests++
+	if status >= 500 {
+		c.errors++
+	}
+	//retries list every upstream time, a request without upstream logs -
+	responseTime, timed := 0.0, false
+	for _, field := range strings.Split(strings.Join(fields[2:], ""), ",") {
+		if t, err := strconv.ParseFloat(strings.TrimSpace(field), 64); err == nil {
+			responseTime += t
+			timed = true
+		}
+	}
+	if timed {
+		c.timed++
+		c.responseTime += responseTime
+	}
+}
+
+func bindingStats(ns route.NginxService, ports map[int]*portCounter) []BindingStats {
+	var totalWeight int
+	var totalRequests int64
+	for _, n := range ns.HttpNginxs() {
+		totalWeight += n.Weight
+		if c, ok := ports[n.Port]; ok {
+			totalRequests += c.requests
+		}
+	}
+	stats := make([]BindingStats, 0)
+	for _, n := range ns.Nginxs {
+		binding := BindingStats{Name: n.Name, Url: n.Url, Role: n.Role, Weight: n.Weight}
+		if c, ok := ports[n.Port]; ok {
+			binding.Requests = c.requests
+			binding.Errors = c.errors
+			if c.requests > 0 {
+				binding.ErrorRate = float64(c.errors) / float64(c.requests)
+			}
+			if c.timed > 0 {
+				binding.UpstreamResponseTime = c.responseTime * 1000 / float64(c.timed)
+			}
+		}
+		//the shares only compare the bindings of the weighted upstream
+		if !n.Mirror() && n.Protocol != route.ProtocolGrpc {
+			if totalWeight > 0 {
+				binding.WeightShare = float64(n.Weight) / float64(totalWeight)
+			}
+			if totalRequests > 0 {
+				binding.RequestShare = float64(binding.Requests) / float64(totalRequests)
+			}
+		}
+		stats = append(stats, binding)
+	}
+	return stats
+}
+
+func (nsb *NginxDataflowServiceBroker) statsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := nsb.Stats(mux.Vars(r)["instance_id"])
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	respond(w, http.StatusOK, stats)
+}
@@ -4,7 +4,11 @@ import (
 	"os"
 	"fmt"
 	"time"
+	"bytes"
 	"strings"
+	"net/url"
+	"net/http"
+	"encoding/json"
 
 	"github.com/cloudfoundry-community/go-cfclient"
 	"github.com/wdxxs2z/nginx-flow-osb/utils"
@@ -12,6 +16,91 @@ import (
 	"path/filepath"
 )
 
+// Domain is either a shared domain or an org private domain, internal domains
+// (apps.internal) are only reachable over container-to-container networking
+type Domain struct {
+	Guid		string
+	Name		string
+	Internal	bool
+	Private		bool
+}
+
+// NetworkPolicy opens container-to-container traffic from the nginx application to a bound
+// application port, the policy server drops the policies of deleted applications itself
+type NetworkPolicy struct {
+	AppGuid		string
+	Port		int
+}
+
+// AppRoute is a route of the application: a http route with an optional path, or a tcp
+// route when Port is set. AppPort is the application port the route is mapped to, 0 is 8080
+type AppRoute struct {
+	Host		string
+	Domain		string
+	Path		string
+	Port		int
+	AppPort		int
+}
+
+func (r AppRoute) String() string {
+	if r.Port > 0 {
+		return fmt.Sprintf("%s:%d", r.Domain, r.Port)
+	}
+	return r.Host + "." + r.Domain + r.Path
+}
+
+func (r AppRoute) applicationPort() int {
+	if r.AppPort == 0 {
+		return 8080
+	}
+	return r.AppPort
+}
+
+// ApplicationSpec is the desired state of a deployed application, on update a zero InstanceNum,
+// Memory, Disk or an empty Buildpack or Stack keeps the value of the origin application
+type ApplicationSpec struct {
+	InstanceNum	int
+	Memory		int
+	Disk		int
+	Buildpack	string
+	Stack		string
+	stackGuid	string
+	Routes		[]AppRoute
+	Policies	[]NetworkPolicy
+	SyslogDrainUrl	string
+}
+
+// ServiceInstancePermissions are the permissions of a user on a service instance, a space developer
+// manages it and a space auditor or manager only reads it
+type ServiceInstancePermissions struct {
+	Manage		bool				`json:"manage"`
+	Read		bool				`json:"read"`
+}
+
+type networkPoliciesRequest struct {
+	Policies	[]networkPolicy			`json:"policies"`
+}
+
+type networkPolicy struct {
+	Source		networkPolicySource		`json:"source"`
+	Destination	networkPolicyDestination	`json:"destination"`
+}
+
+type networkPolicySource struct {
+	Id		string				`json:"id"`
+}
+
+type networkPolicyDestination struct {
+	Id		string				`json:"id"`
+	Protocol	string				`json:"protocol"`
+	Ports		networkPolicyPorts		`json:"ports"`
+}
+
+type networkPolicyPorts struct {
+	Start		int				`json:"start"`
+	End		int				`json:"end"`
+}
+
 func targetCFClient() (*cfclient.Client, error){
 	cfApi := os.Getenv("CF_API")
 	cfUsername := os.Getenv("CF_USERNAME")
@@ -40,11 +129,58 @@ func GetSpaceWorkflow(spaceGuid string, logger lager.Logger)(cfclient.Space,erro
 	return client.GetSpaceByGuid(spaceGuid)
 }
 
-func CreateApplicationWorkflow(appName, spaceName, routeName, domain string, sourceDir string, destinationZip string, instanceNum, memory, disk int, buildpack string, logger lager.Logger) (cfclient.App, error){
+// EnsureServiceSpaceWorkflow returns the space shared by the system space plans, the org and the space
+// are created when missing
+func EnsureServiceSpaceWorkflow(orgName, spaceName string, logger lager.Logger) (cfclient.Space, error){
+	logger.Debug("ensure-cloudfoundry-service-space-workflow", lager.Data{
+		"org_name":      orgName,
+		"space_name":    spaceName,
+	})
+	client, err := targetCFClient()
+	if err != nil {
+		return cfclient.Space{}, err
+	}
+	orgQuery := make(map[string][]string)
+	orgQuery["q"] = []string{fmt.Sprintf("name:%s", orgName)}
+	orgs, err := client.ListOrgsByQuery(orgQuery)
+	if err != nil {
+		return cfclient.Space{}, err
+	}
+	var org cfclient.Org
+	if len(orgs) == 0 {
+		org, err = client.CreateOrg(cfclient.OrgRequest{
+			Name:    orgName,
+		})
+		if err != nil {
+			return cfclient.Space{}, fmt.Errorf("create service org %s err: %s", orgName, err)
+		}
+	} else {
+		org = orgs[0]
+	}
+	spaceQuery := make(map[string][]string)
+	spaceQuery["q"] = []string{fmt.Sprintf("organization_guid:%s", org.Guid), fmt.Sprintf("name:%s", spaceName)}
+	spaces, err := client.ListSpacesByQuery(spaceQuery)
+	if err != nil {
+		return cfclient.Space{}, err
+	}
+	if len(spaces) != 0 {
+		return spaces[0], nil
+	}
+	space, err := client.CreateSpace(cfclient.SpaceRequest{
+		Name:              spaceName,
+		OrganizationGuid:  org.Guid,
+	})
+	if err != nil {
+		return cfclient.Space{}, fmt.Errorf("create service space %s err: %s", spaceName, err)
+	}
+	return space, nil
+}
+
+func CreateApplicationWorkflow(appName, spaceGuid string, sourceDir string, destinationZip string, spec ApplicationSpec, logger lager.Logger) (cfclient.App, error){
 	logger.Debug("create-cloudfoundry-application-workflow", lager.Data{
 		"app_name":    appName,
-		"route_name":  routeName,
-		"domain_name": domain,
+		"space_guid":  spaceGuid,
+		"routes":      spec.Routes,
 	})
 	client, err := targetCFClient()
 	if err != nil {
@@ -55,33 +191,29 @@ func CreateApplicationWorkflow(appName, spaceName, routeName, domain string, sou
 	if err != nil {
 		return cfclient.App{}, err
 	}
+	//refuse routes of other spaces and applications before anything is created
+	err = checkApplicationRoutes(client, spaceGuid, spec.Routes, app.Guid)
+	if err != nil {
+		return cfclient.App{}, err
+	}
 	if app.Name == "" {
-		app, err = createApplication(client, appName, spaceName, instanceNum, memory, disk, buildpack)
+		app, err = createApplication(client, appName, spaceGuid, spec)
 		if err != nil {
 			return cfclient.App{}, err
 		}
 	}
-	//route
-	route, err := getRoute(client, routeName, domain)
+	//routes
+	err = mapApplicationRoutes(client, app.Guid, spaceGuid, spec.Routes)
 	if err != nil {
 		return cfclient.App{}, err
 	}
-	if route.Host == "" {
-		route, err = createRoute(client, routeName, domain, spaceName)
-		if err != nil {
-			return cfclient.App{}, err
-		}
-	}
-	//map
-	mapping, err := getMappingRoute(client, app.Guid, route.Guid)
+	err = createNetworkPolicies(client, app.Guid, spec.Policies)
 	if err != nil {
 		return cfclient.App{}, err
 	}
-	if mapping.Guid == "" {
-		_, err = mapRouteToApplication(client, app.Guid, route.Guid)
-		if err != nil {
-			return cfclient.App{}, err
-		}
+	err = bindSyslogDrain(client, app.Guid, spaceGuid, appName, spec.SyslogDrainUrl)
+	if err != nil {
+		return cfclient.App{}, err
 	}
 	//upload app
 	err = uploadApplication(client, app.Guid, sourceDir, destinationZip)
@@ -96,11 +228,15 @@ func CreateApplicationWorkflow(appName, spaceName, routeName, domain string, sou
 	return app, nil
 }
 
-func UpdateApplicationWorkflow(appName, spaceName, routeName, domainName string, sourceDir string, destinationZip string, logger lager.Logger) (cfclient.App, error){
+// UpdateApplicationWorkflow blue-green deploys the application in the space of the origin application,
+// all routes of the spec are mapped to the blue application, the origin routes left without mapping are deleted
+func UpdateApplicationWorkflow(appName string, sourceDir string, destinationZip string, spec ApplicationSpec, logger lager.Logger) (cfclient.App, error){
 	logger.Debug("update-cloudfoundry-application-workflow", lager.Data{
 		"app_name":    appName,
-		"route_name":  routeName,
-		"domain_name": domainName,
+		"routes":      spec.Routes,
+		"instances":   spec.InstanceNum,
+		"memory":      spec.Memory,
+		"disk":        spec.Disk,
 	})
 	client, err := targetCFClient()
 	if err != nil {
@@ -111,78 +247,287 @@ func UpdateApplicationWorkflow(appName, spaceName, routeName, domainName string,
 	if err != nil {
 		return cfclient.App{}, err
 	}
-	//create a new application blue
-	blueApp, err := createApplication(client, appName + "-blue", spaceName, originApp.Instances, originApp.Memory, originApp.DiskQuota, originApp.Buildpack)
+	if spec.InstanceNum == 0 {
+		spec.InstanceNum = originApp.Instances
+	}
+	if spec.Memory == 0 {
+		spec.Memory = originApp.Memory
+	}
+	if spec.Disk == 0 {
+		spec.Disk = originApp.DiskQuota
+	}
+	if spec.Buildpack == "" {
+		spec.Buildpack = originApp.Buildpack
+	}
+	if spec.Stack == "" {
+		spec.stackGuid = originApp.StackGuid
+	}
+	err = checkApplicationRoutes(client, originApp.SpaceGuid, spec.Routes, originApp.Guid)
 	if err != nil {
 		return cfclient.App{}, err
 	}
-	//create blue application route
-	blueAppRoute, err := getRoute(client, routeName, domainName)
+	//a blue application left by a deploy that died would take the name of the new one
+	leftoverApp, err := getApplication(client, appName + "-blue")
 	if err != nil {
 		return cfclient.App{}, err
 	}
-	if blueAppRoute.Host == "" {
-		blueAppRoute, err = createRoute(client, routeName, domainName, spaceName)
-		if err != nil {
+	if leftoverApp.Guid != "" {
+		if err := cleanApplicationResource(client, leftoverApp); err != nil {
 			return cfclient.App{}, err
 		}
 	}
-	//mapping blue application route to blue application
-	blueAppRouteMapping, err := getMappingRoute(client, blueApp.Guid, blueAppRoute.Guid)
+	//create a new application blue
+	blueApp, err := createApplication(client, appName + "-blue", originApp.SpaceGuid, spec)
 	if err != nil {
 		return cfclient.App{}, err
 	}
-	if blueAppRouteMapping.Guid == "" {
-		blueAppRouteMapping, err = mapRouteToApplication(client, blueApp.Guid, blueAppRoute.Guid)
-		if err != nil {
-			return cfclient.App{}, err
+	//until the origin application is cleaned, a failure deletes the blue application
+	cleanBlue := func(err error) (cfclient.App, error) {
+		if cleanErr := cleanApplicationResource(client, blueApp); cleanErr != nil {
+			return cfclient.App{}, fmt.Errorf("%s, and clean blue app cause an error: %s", err, cleanErr)
 		}
+		return cfclient.App{}, err
+	}
+	//create and map the blue application routes
+	err = mapApplicationRoutes(client, blueApp.Guid, originApp.SpaceGuid, spec.Routes, originApp.Guid)
+	if err != nil {
+		return cleanBlue(err)
+	}
+	//policies belong to the application guid, open them for the blue application before it takes traffic
+	err = createNetworkPolicies(client, blueApp.Guid, spec.Policies)
+	if err != nil {
+		return cleanBlue(err)
+	}
+	err = bindSyslogDrain(client, blueApp.Guid, originApp.SpaceGuid, appName, spec.SyslogDrainUrl)
+	if err != nil {
+		return cleanBlue(err)
 	}
 	//upload bits to blue application
 	err = uploadApplication(client, blueApp.Guid, sourceDir, destinationZip)
 	if err != nil {
-		return cfclient.App{}, err
+		return cleanBlue(err)
 	}
 	//start blue application
 	_, err = updateApplication(client, blueApp.Guid, "STARTED")
 	if err != nil {
-		return cfclient.App{}, err
+		return cleanBlue(err)
 	}
 	//wait for blue application start up, close async mode
-	errChan := make(chan error)
-	successChan := make(chan  bool)
-	timeout := time.Duration(90 * time.Second)
-	go getAppStateAsync(client, blueApp.Guid, errChan, successChan)
-	select {
-	case <- errChan :
-		//delete blue application route mapping, and routes
-		if err = cleanApplicationResource(client, blueApp); err != nil {
+	if err = waitApplicationRunning(client, blueApp); err != nil {
+		return cleanBlue(err)
+	}
+	//delete origin application route mapping and not origin app exist routes
+	err = cleanApplicationResource(client, originApp)
+	if err != nil {
+		return cfclient.App{}, err
+	}
+	if spec.SyslogDrainUrl == "" {
+		if err = deleteSyslogDrain(client, originApp.SpaceGuid, appName); err != nil {
 			return cfclient.App{}, err
 		}
+	}
+	//rename blue application name to origin app name
+	err = renameApplication(client, blueApp.Guid, appName)
+	if err != nil {
 		return cfclient.App{}, err
-	case <- successChan :
-		//delete origin application route mapping and not origin app exist routes
-		err = cleanApplicationResource(client, originApp)
-		if err != nil {
+	}
+	return blueApp, nil
+}
+
+// MigrateApplicationWorkflow moves the application to another space: a blue application is started in
+// the target space, the routes are recreated there and mapped to it, then the origin application is deleted.
+// Routes belong to a space, so each route is unreachable between its deletion and the new mapping.
+func MigrateApplicationWorkflow(appName, targetSpaceGuid string, sourceDir string, destinationZip string, spec ApplicationSpec, logger lager.Logger) (cfclient.App, error){
+	logger.Debug("migrate-cloudfoundry-application-workflow", lager.Data{
+		"app_name":    appName,
+		"space_guid":  targetSpaceGuid,
+		"routes":      spec.Routes,
+	})
+	client, err := targetCFClient()
+	if err != nil {
+		return cfclient.App{}, err
+	}
+	originApp , err := getApplication(client, appName)
+	if err != nil {
+		return cfclient.App{}, err
+	}
+	if originApp.Guid == "" {
+		return cfclient.App{}, fmt.Errorf("application %s not found", appName)
+	}
+	if originApp.SpaceGuid == targetSpaceGuid {
+		return originApp, nil
+	}
+	if spec.Stack == "" {
+		spec.stackGuid = originApp.StackGuid
+	}
+	//the routes are in the origin space until the cut over
+	err = checkApplicationRoutes(client, "", spec.Routes, originApp.Guid)
+	if err != nil {
+		return cfclient.App{}, err
+	}
+	//a blue application left by a failed migration would take the name of the new one
+	leftoverApp, err := getApplication(client, appName + "-blue")
+	if err != nil {
+		return cfclient.App{}, err
+	}
+	if leftoverApp.Guid != "" {
+		if err := cleanApplicationResource(client, leftoverApp); err != nil {
 			return cfclient.App{}, err
 		}
-		//rename blue application name to origin app name
-		err = renameApplication(client, blueApp.Guid, appName)
+	}
+	//start the blue application in the target space without route
+	blueApp, err := createApplication(client, appName + "-blue", targetSpaceGuid, spec)
+	if err != nil {
+		return cfclient.App{}, err
+	}
+	//until the origin application is deleted, a failure deletes the blue application
+	//and gives the routes already cut over back to the origin application
+	cutRoutes := make([]AppRoute, 0)
+	rollback := func(err error) (cfclient.App, error) {
+		if cleanErr := cleanApplicationResource(client, blueApp); cleanErr != nil {
+			return cfclient.App{}, fmt.Errorf("%s, and clean blue app cause an error: %s", err, cleanErr)
+		}
+		if len(cutRoutes) > 0 {
+			if mapErr := mapApplicationRoutes(client, originApp.Guid, originApp.SpaceGuid, cutRoutes); mapErr != nil {
+				return cfclient.App{}, fmt.Errorf("%s, and map the routes back to the origin app cause an error: %s", err, mapErr)
+			}
+		}
+		return cfclient.App{}, err
+	}
+	err = createNetworkPolicies(client, blueApp.Guid, spec.Policies)
+	if err != nil {
+		return rollback(err)
+	}
+	err = bindSyslogDrain(client, blueApp.Guid, targetSpaceGuid, appName, spec.SyslogDrainUrl)
+	if err != nil {
+		return rollback(err)
+	}
+	err = uploadApplication(client, blueApp.Guid, sourceDir, destinationZip)
+	if err != nil {
+		return rollback(err)
+	}
+	_, err = updateApplication(client, blueApp.Guid, "STARTED")
+	if err != nil {
+		return rollback(err)
+	}
+	if err = waitApplicationRunning(client, blueApp); err != nil {
+		return rollback(err)
+	}
+	//every route is checked again before any is unmapped from the origin application
+	originRoutes := make([]cfclient.Route, 0)
+	originAppRoutes := make([]AppRoute, 0)
+	for _, appRoute := range spec.Routes {
+		originRoute, err := getRoute(client, appRoute)
+		if err != nil {
+			return rollback(err)
+		}
+		if originRoute.Guid == "" || originRoute.SpaceGuid == targetSpaceGuid {
+			continue
+		}
+		err = checkRouteOwnership(client, originRoute, "", appRoute, originApp.Guid)
 		if err != nil {
-			return cfclient.App{}, err
+			return rollback(err)
 		}
-	case <- time.After(timeout):
-		if err = cleanApplicationResource(client, blueApp); err != nil {
-			return cfclient.App{}, fmt.Errorf("update blue timeout, and clean blue app cause an error: %s", err)
+		originRoutes = append(originRoutes, originRoute)
+		originAppRoutes = append(originAppRoutes, appRoute)
+	}
+	//cut the routes over to the target space
+	for index, originRoute := range originRoutes {
+		cutRoutes = append(cutRoutes, originAppRoutes[index])
+		err = unmappingRouteWithApplication(client, originApp.Guid, originRoute.Guid)
+		if err != nil {
+			return rollback(err)
+		}
+		err = deleteAppRoute(client, originRoute.Guid)
+		if err != nil {
+			return rollback(err)
 		}
-		return cfclient.App{}, fmt.Errorf("get blue app(%s) state timeout(%d)", blueApp.Name, timeout)
 	}
-	defer close(successChan)
-	defer close(errChan)
-
+	err = mapApplicationRoutes(client, blueApp.Guid, targetSpaceGuid, spec.Routes)
+	if err != nil {
+		return rollback(err)
+	}
+	//delete the origin application and rename the blue one
+	err = cleanApplicationResource(client, originApp)
+	if err != nil {
+		return rollback(err)
+	}
+	//the blue application has the traffic now, it is kept whatever fails below
+	//the drain of the origin space is left without application
+	err = deleteSyslogDrain(client, originApp.SpaceGuid, appName)
+	if err != nil {
+		return blueApp, err
+	}
+	err = renameApplication(client, blueApp.Guid, appName)
+	if err != nil {
+		return blueApp, err
+	}
 	return blueApp, nil
 }
 
+// UpdateApplicationRoutesWorkflow maps the routes to the running application without a redeploy,
+// routes of the application missing from the list are unmapped, and deleted when nothing else maps them
+func UpdateApplicationRoutesWorkflow(appName string, routes []AppRoute, logger lager.Logger) error{
+	logger.Debug("update-cloudfoundry-application-routes-workflow", lager.Data{
+		"app_name":    appName,
+		"routes":      routes,
+	})
+	client, err := targetCFClient()
+	if err != nil {
+		return err
+	}
+	app, err := getApplication(client, appName)
+	if err != nil {
+		return err
+	}
+	if app.Guid == "" {
+		return fmt.Errorf("application %s not found", appName)
+	}
+	err = checkApplicationRoutes(client, app.SpaceGuid, routes, app.Guid)
+	if err != nil {
+		return err
+	}
+	err = mapApplicationRoutes(client, app.Guid, app.SpaceGuid, routes, app.Guid)
+	if err != nil {
+		return err
+	}
+	mappedRoutes, err := getApplicationRoutes(client, app.Guid)
+	if err != nil {
+		return err
+	}
+	for _, mappedRoute := range mappedRoutes {
+		wanted := false
+		for _, appRoute := range routes {
+			r, err := getRoute(client, appRoute)
+			if err != nil {
+				return err
+			}
+			if r.Guid == mappedRoute.Guid {
+				wanted = true
+				break
+			}
+		}
+		if wanted {
+			continue
+		}
+		err = unmappingRouteWithApplication(client, app.Guid, mappedRoute.Guid)
+		if err != nil {
+			return err
+		}
+		mappings, err := getRouteMappingsWithRoute(client, mappedRoute.Guid)
+		if err != nil {
+			return err
+		}
+		if len(mappings) == 0 {
+			err = deleteAppRoute(client, mappedRoute.Guid)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func DeleteApplcationWorkflow(appName string, instanceDir string, logger lager.Logger) error{
 	logger.Debug("delete-cloudfoundry-application-workflow", lager.Data{
 		"app_name":    appName,
@@ -213,7 +558,11 @@ func DeleteApplcationWorkflow(appName string, instanceDir string, logger lager.L
 	if err != nil {
 		return err
 	}
-	return deleteApplication(client, app.Name)
+	err = deleteApplication(client, app.Name)
+	if err != nil {
+		return err
+	}
+	return deleteSyslogDrain(client, app.SpaceGuid, appName)
 }
 
 func CheckApplicationExistWorkflow(appName string, logger lager.Logger) (bool, error) {
@@ -271,24 +620,106 @@ func GetApplicationRouteWorkflow(appGuid string, logger lager.Logger) ([]cfclien
 	return getApplicationRoutes(client, appGuid)
 }
 
-func GetDomainWorkflow(domainGuid string, logger lager.Logger) (cfclient.SharedDomain, error){
+func GetDomainWorkflow(domainGuid string, logger lager.Logger) (Domain, error){
 	logger.Debug("fetch-cloudfoundry-domain-workflow", lager.Data{
 		"domain_guid":    domainGuid,
 	})
 	client, err := targetCFClient()
 	if err != nil {
-		return cfclient.SharedDomain{}, err
+		return Domain{}, err
 	}
 	sharedDomains, err := client.ListSharedDomains()
 	if err != nil {
-		return cfclient.SharedDomain{}, err
+		return Domain{}, err
 	}
 	for _,sharedDomain := range sharedDomains {
 		if sharedDomain.Guid == domainGuid {
-			return sharedDomain, nil
+			return Domain{Guid: sharedDomain.Guid, Name: sharedDomain.Name, Internal: sharedDomain.Internal}, nil
+		}
+	}
+	privateDomains, err := client.ListDomains()
+	if err != nil {
+		return Domain{}, err
+	}
+	for _,privateDomain := range privateDomains {
+		if privateDomain.Guid == domainGuid {
+			return Domain{Guid: privateDomain.Guid, Name: privateDomain.Name, Private: true}, nil
+		}
+	}
+	return Domain{}, fmt.Errorf("domain not found with %s", domainGuid)
+}
+
+// MapInternalRouteWorkflow maps the route host.<internal domain> to the application, the route is
+// reused when it is already mapped to the application and refused when it is mapped to another one
+func MapInternalRouteWorkflow(appGuid, host string, logger lager.Logger) (string, error){
+	logger.Debug("map-cloudfoundry-internal-route-workflow", lager.Data{
+		"app_guid":    appGuid,
+		"host":        host,
+	})
+	client, err := targetCFClient()
+	if err != nil {
+		return "", err
+	}
+	app, err := client.GetAppByGuid(appGuid)
+	if err != nil {
+		return "", err
+	}
+	sharedDomains, err := client.ListSharedDomains()
+	if err != nil {
+		return "", err
+	}
+	domainName := ""
+	for _,sharedDomain := range sharedDomains {
+		if sharedDomain.Internal {
+			domainName = sharedDomain.Name
+			break
+		}
+	}
+	if domainName == "" {
+		return "", fmt.Errorf("the platform has no internal domain")
+	}
+	err = mapApplicationRoutes(client, appGuid, app.SpaceGuid, []AppRoute{{Host: host, Domain: domainName}})
+	if err != nil {
+		return "", err
+	}
+	return host + "." + domainName, nil
+}
+
+// CreateTcpRouteWorkflow creates a tcp route with a port picked by the platform, an empty domain
+// picks the first shared domain of a tcp router group
+func CreateTcpRouteWorkflow(domainName, spaceGuid string, logger lager.Logger) (AppRoute, error){
+	logger.Debug("create-cloudfoundry-tcp-route-workflow", lager.Data{
+		"domain_name":    domainName,
+		"space_guid":     spaceGuid,
+	})
+	client, err := targetCFClient()
+	if err != nil {
+		return AppRoute{}, err
+	}
+	sharedDomains, err := client.ListSharedDomains()
+	if err != nil {
+		return AppRoute{}, err
+	}
+	for _,sharedDomain := range sharedDomains {
+		if sharedDomain.RouterGroupType != "tcp" {
+			continue
+		}
+		if domainName != "" && sharedDomain.Name != domainName {
+			continue
+		}
+		route, err := client.CreateTcpRoute(cfclient.RouteRequest{
+			DomainGuid:       sharedDomain.Guid,
+			SpaceGuid:        spaceGuid,
+		})
+		if err != nil {
+			return AppRoute{}, err
 		}
+		return AppRoute{Domain: sharedDomain.Name, Port: route.Port}, nil
+	}
+	if domainName != "" {
+		return AppRoute{}, fmt.Errorf("%s is not a tcp domain", domainName)
 	}
-	return cfclient.SharedDomain{}, fmt.Errorf("domain not found with %s", domainGuid)
+	return AppRoute{}, fmt.Errorf("the platform has no tcp router group")
 }
 
 func CheckApplicationStateWorkflow(appName string, logger lager.Logger) (string, error){
@@ -320,6 +751,195 @@ func CheckApplicationStateWorkflow(appName string, logger lager.Logger) (string,
 	}
 }
 
+// GetAuthEndpointWorkflow returns the uaa endpoints announced by the cloud controller
+func GetAuthEndpointWorkflow(logger lager.Logger) (cfclient.Endpoint, error) {
+	logger.Debug("fetch-cloudfoundry-auth-endpoint-workflow", lager.Data{})
+	client, err := targetCFClient()
+	if err != nil {
+		return cfclient.Endpoint{}, err
+	}
+	return client.Endpoint, nil
+}
+
+// GetServiceInstancesPermissionsWorkflow asks the cloud controller with the token of a user what the user
+// may do on each service instance, the service instances the user can not see are left out
+func GetServiceInstancesPermissionsWorkflow(instanceGuids []string, userToken string, logger lager.Logger) (map[string]ServiceInstancePermissions, error) {
+	logger.Debug("fetch-cloudfoundry-service-instances-permissions-workflow", lager.Data{
+		"instance_guids":	instanceGuids,
+	})
+	client, err := userCFClient(userToken)
+	if err != nil {
+		return nil, err
+	}
+	permissions := make(map[string]ServiceInstancePermissions)
+	for _, guid := range instanceGuids {
+		permission, _, err := getServiceInstancePermissions(client, guid)
+		if err != nil {
+			return nil, err
+		}
+		if permission.Read || permission.Manage {
+			permissions[guid] = permission
+		}
+	}
+	return permissions, nil
+}
+
+// GetVisibleServiceInstancesWorkflow lists the service instances of the plans the user can see, with the
+// permissions of the user on them. The permissions follow the space roles, they are asked once per space
+func GetVisibleServiceInstancesWorkflow(planIds []string, userToken string, logger lager.Logger) (map[string]ServiceInstancePermissions, error) {
+	logger.Debug("fetch-cloudfoundry-visible-service-instances-workflow", lager.Data{
+		"plan_ids":	planIds,
+	})
+	permissions := make(map[string]ServiceInstancePermissions)
+	if len(planIds) == 0 {
+		return permissions, nil
+	}
+	//the plan guids of the cloud controller, the broker sees every plan of its services
+	brokerClient, err := targetCFClient()
+	if err != nil {
+		return nil, err
+	}
+	plans, err := brokerClient.ListServicePlansByQuery(url.Values{"q": []string{"unique_id IN " + strings.Join(planIds, ",")}})
+	if err != nil {
+		return nil, err
+	}
+	if len(plans) == 0 {
+		return permissions, nil
+	}
+	planGuids := make([]string, 0)
+	for _, plan := range plans {
+		planGuids = append(planGuids, plan.Guid)
+	}
+	client, err := userCFClient(userToken)
+	if err != nil {
+		return nil, err
+	}
+	instances, err := client.ListServiceInstancesByQuery(url.Values{"q": []string{"service_plan_guid IN " + strings.Join(planGuids, ",")}})
+	if err != nil {
+		return nil, err
+	}
+	spacePermissions := make(map[string]ServiceInstancePermissions)
+	for _, instance := range instances {
+		permission, ok := spacePermissions[instance.SpaceGuid]
+		if !ok {
+			permission, ok, err = getServiceInstancePermissions(client, instance.Guid)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				spacePermissions[instance.SpaceGuid] = permission
+			}
+		}
+		if permission.Read || permission.Manage {
+			permissions[instance.Guid] = permission
+		}
+	}
+	return permissions, nil
+}
+
+func userCFClient(userToken string) (*cfclient.Client, error) {
+	return cfclient.NewClient(&cfclient.Config{
+		ApiAddress:        os.Getenv("CF_API"),
+		Token:             userToken,
+		SkipSslValidation: true,
+	})
+}
+
+//an instance unknown to the cloud controller or hidden from the user has no permission, which tells nothing
+//about its space. Any other error, such as an expired token or an outage, is returned
+func getServiceInstancePermissions(client *cfclient.Client, guid string) (ServiceInstancePermissions, bool, error) {
+	resp, err := client.DoRequest(client.NewRequest("GET", "/v2/service_instances/" + guid + "/permissions"))
+	if err != nil {
+		if cfclient.IsServiceInstanceNotFoundError(err) || cfclient.IsNotAuthorizedError(err) {
+			return ServiceInstancePermissions{}, false, nil
+		}
+		if httpErr, ok := err.(cfclient.CloudFoundryHTTPError); ok && (httpErr.StatusCode == http.StatusNotFound || httpErr.StatusCode == http.StatusForbidden) {
+			return ServiceInstancePermissions{}, false, nil
+		}
+		return ServiceInstancePermissions{}, false, err
+	}
+	defer resp.Body.Close()
+	var permission ServiceInstancePermissions
+	if err := json.NewDecoder(resp.Body).Decode(&permission); err != nil {
+		return ServiceInstancePermissions{}, false, err
+	}
+	return permission, true, nil
+}
+
+// GetApplicationsWorkflow returns the applications found by name, a missing application is left out
+func GetApplicationsWorkflow(appNames []string, logger lager.Logger) (map[string]cfclient.App, error){
+	logger.Debug("fetch-cloudfoundry-applications-workflow", lager.Data{
+		"app_names":    appNames,
+	})
+	client, err := targetCFClient()
+	if err != nil {
+		return nil, err
+	}
+	apps := make(map[string]cfclient.App)
+	for _, appName := range appNames {
+		app, err := getApplication(client, appName)
+		if err != nil {
+			return nil, err
+		}
+		if app.Guid != "" {
+			apps[appName] = app
+		}
+	}
+	return apps, nil
+}
+
+// GetCurrentDropletWorkflow returns the guid of the droplet the application runs, empty while it is staging
+func GetCurrentDropletWorkflow(appGuid string, logger lager.Logger) (string, error){
+	logger.Debug("fetch-cloudfoundry-current-droplet-workflow", lager.Data{
+		"app_guid":    appGuid,
+	})
+	client, err := targetCFClient()
+	if err != nil {
+		return "", err
+	}
+	//the v3 errors do not decode into the errors of the client, the status is checked here
+	resp, err := client.Config.HttpClient.Get(client.Config.ApiAddress + "/v3/apps/" + appGuid + "/droplets/current")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get current droplet returned %d", resp.StatusCode)
+	}
+	var droplet struct {
+		Guid	string	`json:"guid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&droplet); err != nil {
+		return "", err
+	}
+	return droplet.Guid, nil
+}
+
+func GetStackWorkflow(stackName string, logger lager.Logger) (cfclient.Stack, error){
+	logger.Debug("fetch-cloudfoundry-stack-workflow", lager.Data{
+		"stack":    stackName,
+	})
+	client, err := targetCFClient()
+	if err != nil {
+		return cfclient.Stack{}, err
+	}
+	return getStack(client, stackName)
+}
+
+func getStack(client *cfclient.Client, stackName string) (cfclient.Stack, error) {
+	stacks, err := client.ListStacksByQuery(url.Values{"q": []string{"name:" + stackName}})
+	if err != nil {
+		return cfclient.Stack{}, err
+	}
+	if len(stacks) == 0 {
+		return cfclient.Stack{}, fmt.Errorf("stack %s not found", stackName)
+	}
+	return stacks[0], nil
+}
+
 func cleanApplicationResource(client *cfclient.Client, oldApp cfclient.App) error{
 	oldRoutes, err := getApplicationRoutes(client, oldApp.Guid)
 	if err != nil {
@@ -350,22 +970,27 @@ func cleanApplicationResource(client *cfclient.Client, oldApp cfclient.App) erro
 	return nil
 }
 
-func getAppStateAsync(client *cfclient.Client, appGuid string, errChan chan error, successChan chan bool){
-	appStates, err := client.GetAppStats(appGuid)
-	if err != nil{
-		errChan <- err
-	}
-	s := appStates["0"].State
-	switch s {
-	case "RUNNING":
-		successChan <- true
-	case "STARTING":
-		getAppStateAsync(client, appGuid, errChan, successChan)
-	case "CRASHED":
-		errChan <- fmt.Errorf("app crashed error")
-	case "DOWN":
-		getAppStateAsync(client, appGuid, errChan, successChan)
+// waitApplicationRunning polls the first instance of the application until it runs,
+// staging is part of the wait
+func waitApplicationRunning(client *cfclient.Client, app cfclient.App) error {
+	timeout := time.Duration(90 * time.Second)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		appStates, err := client.GetAppStats(app.Guid)
+		if err != nil && !cfclient.IsNotStagedError(err) {
+			return fmt.Errorf("app(%s) start failed: %s", app.Name, err)
+		}
+		if err == nil {
+			switch appStates["0"].State {
+			case "RUNNING":
+				return nil
+			case "CRASHED":
+				return fmt.Errorf("app(%s) start failed: app crashed error", app.Name)
+			}
+		}
+		time.Sleep(2 * time.Second)
 	}
+	return fmt.Errorf("get app(%s) state timeout(%s)", app.Name, timeout)
 }
 
 func getApplicationRoutes(client *cfclient.Client, appGuid string) ([]cfclient.Route, error){
@@ -377,72 +1002,81 @@ func getApplicationRoutes(client *cfclient.Client, appGuid string) ([]cfclient.R
 }
 
 func getDomainGuid(client *cfclient.Client, domain string) (string, error) {
-	sharedDomain, err := client.GetSharedDomainByName(domain)
+	d, err := getDomain(client, domain)
 	if err != nil {
 		return "", err
 	}
-	return sharedDomain.Guid, nil
+	return d.Guid, nil
 }
 
-func getDomain(client *cfclient.Client, domain string) (cfclient.SharedDomain, error){
-	sharedDomain, err := client.GetSharedDomainByName(domain)
+//shared domains win over org private domains with the same name
+func getDomain(client *cfclient.Client, domain string) (Domain, error){
+	q := url.Values{}
+	q.Set("q", "name:" + domain)
+	sharedDomains, err := client.ListSharedDomainsByQuery(q)
 	if err != nil {
-		return cfclient.SharedDomain{}, err
+		return Domain{}, err
 	}
-	return sharedDomain, nil
-}
-
-func getSpaceGuid(client *cfclient.Client, spaceName string) (string, error) {
-	org, err := client.GetOrgByName("system")
-	if err != nil {
-		return "", err
+	if len(sharedDomains) > 0 {
+		return Domain{Guid: sharedDomains[0].Guid, Name: sharedDomains[0].Name, Internal: sharedDomains[0].Internal}, nil
 	}
-	space, err := client.GetSpaceByName(spaceName, org.Guid)
+	privateDomains, err := client.ListDomainsByQuery(q)
 	if err != nil {
-		return "", err
+		return Domain{}, err
+	}
+	if len(privateDomains) > 0 {
+		return Domain{Guid: privateDomains[0].Guid, Name: privateDomains[0].Name, Private: true}, nil
 	}
-	return space.Guid, nil
+	return Domain{}, fmt.Errorf("neither a shared nor a private domain named %s", domain)
 }
 
-func getRoute(client *cfclient.Client, hostName string, domain string) (cfclient.Route , error){
-	domainGuid, err := getDomainGuid(client, domain)
+func getRoute(client *cfclient.Client, appRoute AppRoute) (cfclient.Route , error){
+	domainGuid, err := getDomainGuid(client, appRoute.Domain)
 	if err != nil {
 		return cfclient.Route{}, err
 	}
 	query := make(map[string][]string)
-	hostQuery := fmt.Sprintf("host:%s", hostName)
 	domainQuery := fmt.Sprintf("domain_guid:%s", domainGuid)
-	query["q"] = []string{hostQuery, domainQuery}
+	if appRoute.Port > 0 {
+		query["q"] = []string{domainQuery, fmt.Sprintf("port:%d", appRoute.Port)}
+	} else {
+		query["q"] = []string{domainQuery, fmt.Sprintf("host:%s", appRoute.Host)}
+	}
 	routers, err := client.ListRoutesByQuery(query)
 	if err != nil {
 		return cfclient.Route{}, err
 	}
-	if len(routers) == 0 {
-		return cfclient.Route{}, nil
+	//routes with a path share host and domain with the route without path
+	for _, router := range routers {
+		if router.Path == appRoute.Path {
+			return router, nil
+		}
 	}
-	return routers[0], nil
+	return cfclient.Route{}, nil
 }
 
-func createRoute(client *cfclient.Client, host, domain, space string) (cfclient.Route, error){
-	route , err := getRoute(client, host, domain)
+func createRoute(client *cfclient.Client, appRoute AppRoute, spaceGuid string) (cfclient.Route, error){
+	route , err := getRoute(client, appRoute)
 	if err != nil {
 		return cfclient.Route{}, err
 	}
+	//an existing route is only reused in the same space
 	if route.Guid != "" {
+		if route.SpaceGuid != spaceGuid {
+			return cfclient.Route{}, fmt.Errorf("route %s belongs to another space", appRoute)
+		}
 		return route, nil
 	}
-	domain_guid, err := getDomainGuid(client, domain)
-	if err != nil {
-		return cfclient.Route{}, err
-	}
-	space_guid, err := getSpaceGuid(client, space)
+	domain_guid, err := getDomainGuid(client, appRoute.Domain)
 	if err != nil {
 		return cfclient.Route{}, err
 	}
 	routeRequest := cfclient.RouteRequest{
 		DomainGuid:       domain_guid,
-		SpaceGuid:        space_guid,
-		Host:             host,
+		SpaceGuid:        spaceGuid,
+		Host:             appRoute.Host,
+		Path:             appRoute.Path,
+		Port:             appRoute.Port,
 	}
 	route, err = client.CreateRoute(routeRequest)
 	if err != nil {
@@ -454,6 +1088,74 @@ func createRoute(client *cfclient.Client, host, domain, space string) (cfclient.
 	return route, nil
 }
 
+// mapApplicationRoutes creates the missing routes in the space and maps every route to the application,
+// a route mapped to an application other than appGuid and ownerGuids is refused
+func mapApplicationRoutes(client *cfclient.Client, appGuid, spaceGuid string, routes []AppRoute, ownerGuids ...string) error {
+	for _, appRoute := range routes {
+		route, err := createRoute(client, appRoute, spaceGuid)
+		if err != nil {
+			return err
+		}
+		err = checkRouteOwnership(client, route, spaceGuid, appRoute, append(ownerGuids, appGuid)...)
+		if err != nil {
+			return err
+		}
+		mapping, err := getMappingRoute(client, appGuid, route.Guid)
+		if err != nil {
+			return err
+		}
+		if mapping.Guid == "" {
+			_, err = mapRouteToApplication(client, appGuid, route.Guid, appRoute.applicationPort())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkApplicationRoutes checks the existing routes before they are mapped, an empty spaceGuid skips the space check
+func checkApplicationRoutes(client *cfclient.Client, spaceGuid string, routes []AppRoute, ownerGuids ...string) error {
+	for _, appRoute := range routes {
+		route, err := getRoute(client, appRoute)
+		if err != nil {
+			return err
+		}
+		if route.Guid == "" {
+			continue
+		}
+		err = checkRouteOwnership(client, route, spaceGuid, appRoute, ownerGuids...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRouteOwnership refuses a route of another space, or mapped to an application which is not one of ownerGuids
+func checkRouteOwnership(client *cfclient.Client, route cfclient.Route, spaceGuid string, appRoute AppRoute, ownerGuids ...string) error {
+	if spaceGuid != "" && route.SpaceGuid != spaceGuid {
+		return fmt.Errorf("route %s belongs to another space", appRoute)
+	}
+	mappings, err := getRouteMappingsWithRoute(client, route.Guid)
+	if err != nil {
+		return err
+	}
+	for _, mapping := range mappings {
+		owned := false
+		for _, ownerGuid := range ownerGuids {
+			if ownerGuid != "" && mapping.AppGUID == ownerGuid {
+				owned = true
+				break
+			}
+		}
+		if !owned {
+			return fmt.Errorf("route %s is mapped to another application", appRoute)
+		}
+	}
+	return nil
+}
+
 func deleteAppRoute(client *cfclient.Client, routeGuid string) (error) {
 	return client.DeleteRoute(routeGuid)
 }
@@ -480,11 +1182,11 @@ func getRouteMappingsWithRoute(client *cfclient.Client, routeGuid string) ([]*cf
 	return mappings, nil
 }
 
-func mapRouteToApplication(client *cfclient.Client, appGuid, routeGuid string) (*cfclient.RouteMapping, error){
+func mapRouteToApplication(client *cfclient.Client, appGuid, routeGuid string, appPort int) (*cfclient.RouteMapping, error){
 	mapRequest := cfclient.RouteMappingRequest{
 		AppGUID:        appGuid,
 		RouteGUID:      routeGuid,
-		AppPort:        8080,
+		AppPort:        appPort,
 	}
 	routeMapping, err := client.MappingAppAndRoute(mapRequest)
 	return routeMapping, err
@@ -520,11 +1222,7 @@ func getMappingRoute(client *cfclient.Client, appGuid, routeGuid string) (*cfcli
 	return mappings[0], nil
 }
 
-func createApplication(client *cfclient.Client, appName, spaceName string, instanceNum, memory, disk int, buildpack string) (cfclient.App, error){
-	spaceGuid, err := getSpaceGuid(client, spaceName)
-	if err != nil {
-		return cfclient.App{}, err
-	}
+func createApplication(client *cfclient.Client, appName, spaceGuid string, spec ApplicationSpec) (cfclient.App, error){
 	appRequest := cfclient.AppCreateRequest{
 		Name:       appName,
 		SpaceGuid:  spaceGuid,
@@ -536,10 +1234,28 @@ func createApplication(client *cfclient.Client, appName, spaceName string, insta
 	aur := cfclient.AppUpdateResource{
 		Name:           app.Name,
 		SpaceGuid:      app.SpaceGuid,
-		Memory:		memory,
-		DiskQuota: 	disk,
-		Instances:      instanceNum,
-		Buildpack:      buildpack,
+		Memory:		spec.Memory,
+		DiskQuota: 	spec.Disk,
+		Instances:      spec.InstanceNum,
+		Buildpack:      spec.Buildpack,
+		StackGuid:      spec.stackGuid,
+	}
+	if spec.Stack != "" {
+		stack, err := getStack(client, spec.Stack)
+		if err != nil {
+			return cfclient.App{}, err
+		}
+		aur.StackGuid = stack.Guid
+	}
+	//routes mapped to other ports than 8080 need the ports opened on the application
+	for _, appRoute := range spec.Routes {
+		if appRoute.applicationPort() == 8080 {
+			continue
+		}
+		if len(aur.Ports) == 0 {
+			aur.Ports = []int{8080}
+		}
+		aur.Ports = append(aur.Ports, appRoute.applicationPort())
 	}
 	_, err = client.UpdateApp(app.Guid, aur)
 	if err != nil {
@@ -574,6 +1290,16 @@ func deleteApplication(client *cfclient.Client, appName string) error{
 	if err != nil {
 		return err
 	}
+	//cloud controller refuses to delete an application with service bindings
+	bindings, err := client.ListServiceBindingsByQuery(url.Values{"q": []string{"app_guid:" + app.Guid}})
+	if err != nil {
+		return err
+	}
+	for _, binding := range bindings {
+		if err := client.DeleteServiceBinding(binding.Guid); err != nil {
+			return err
+		}
+	}
 	return client.DeleteApp(app.Guid)
 }
 
@@ -602,4 +1328,119 @@ func uploadApplication(client *cfclient.Client, appGuid, source, des string) err
 
 func removeInstanceDir(dir string) error {
 	return os.RemoveAll(dir)
-}
\ No newline at end of file
+}
+
+func createNetworkPolicies(client *cfclient.Client, sourceAppGuid string, policies []NetworkPolicy) error {
+	if len(policies) == 0 {
+		return nil
+	}
+	request := networkPoliciesRequest{}
+	for _,policy := range policies {
+		request.Policies = append(request.Policies, networkPolicy{
+			Source:		networkPolicySource{Id: sourceAppGuid},
+			Destination:	networkPolicyDestination{
+				Id:		policy.AppGuid,
+				Protocol:	"tcp",
+				Ports:		networkPolicyPorts{Start: policy.Port, End: policy.Port},
+			},
+		})
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	r := client.NewRequestWithBody("POST", "/networking/v1/external/policies", bytes.NewReader(body))
+	resp, err := client.DoRequest(r)
+	if err != nil {
+		return fmt.Errorf("create network policies err: %s", err)
+	}
+	defer resp.Body.Close()
+	return nil
+}
+
+// syslogDrainName is the user provided service draining the logs of the application, it keeps
+// the name of the application across blue-green deploys
+func syslogDrainName(appName string) string {
+	return appName + "-syslog-drain"
+}
+
+func getSyslogDrain(client *cfclient.Client, spaceGuid, appName string) (cfclient.UserProvidedServiceInstance, error) {
+	query := url.Values{"q": []string{"name:" + syslogDrainName(appName), "space_guid:" + spaceGuid}}
+	instances, err := client.ListUserProvidedServiceInstancesByQuery(query)
+	if err != nil {
+		return cfclient.UserProvidedServiceInstance{}, err
+	}
+	if len(instances) == 0 {
+		return cfclient.UserProvidedServiceInstance{}, nil
+	}
+	return instances[0], nil
+}
+
+// bindSyslogDrain creates or updates the syslog drain of the application and binds it, an empty url binds nothing
+func bindSyslogDrain(client *cfclient.Client, appGuid, spaceGuid, appName, drainUrl string) error {
+	if drainUrl == "" {
+		return nil
+	}
+	drain, err := getSyslogDrain(client, spaceGuid, appName)
+	if err != nil {
+		return err
+	}
+	if drain.Guid == "" {
+		created, err := client.CreateUserProvidedServiceInstance(cfclient.UserProvidedServiceInstanceRequest{
+			Name:           syslogDrainName(appName),
+			SpaceGuid:      spaceGuid,
+			SyslogDrainUrl: drainUrl,
+		})
+		if err != nil {
+			return fmt.Errorf("create syslog drain err: %s", err)
+		}
+		drain = *created
+	} else if drain.SyslogDrainUrl != drainUrl {
+		body, err := json.Marshal(map[string]string{"syslog_drain_url": drainUrl})
+		if err != nil {
+			return err
+		}
+		r := client.NewRequestWithBody("PUT", "/v2/user_provided_service_instances/" + drain.Guid, bytes.NewReader(body))
+		resp, err := client.DoRequest(r)
+		if err != nil {
+			return fmt.Errorf("update syslog drain err: %s", err)
+		}
+		resp.Body.Close()
+	}
+	bindings, err := client.ListServiceBindingsByQuery(url.Values{"q": []string{"app_guid:" + appGuid, "service_instance_guid:" + drain.Guid}})
+	if err != nil {
+		return err
+	}
+	if len(bindings) > 0 {
+		return nil
+	}
+	_, err = client.CreateServiceBinding(appGuid, drain.Guid)
+	if err != nil {
+		return fmt.Errorf("bind syslog drain err: %s", err)
+	}
+	return nil
+}
+
+// deleteSyslogDrain deletes the syslog drain of the application once no application is bound to it
+func deleteSyslogDrain(client *cfclient.Client, spaceGuid, appName string) error {
+	drain, err := getSyslogDrain(client, spaceGuid, appName)
+	if err != nil {
+		return err
+	}
+	if drain.Guid == "" {
+		return nil
+	}
+	bindings, err := client.ListServiceBindingsByQuery(url.Values{"q": []string{"service_instance_guid:" + drain.Guid}})
+	if err != nil {
+		return err
+	}
+	if len(bindings) > 0 {
+		return nil
+	}
+	resp, err := client.DoRequest(client.NewRequest("DELETE", "/v2/user_provided_service_instances/" + drain.Guid))
+	if err != nil {
+		return fmt.Errorf("delete syslog drain err: %s", err)
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -2,16 +2,20 @@ package main
 
 import (
 	"github.com/wdxxs2z/nginx-flow-osb/config"
+	"github.com/wdxxs2z/nginx-flow-osb/route"
 	"errors"
 	"os"
 	"io/ioutil"
 	"fmt"
+	"regexp"
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
 	Username		string		`yaml:"username"`
 	Password		string		`yaml:"password"`
+	AdminUsername		string		`yaml:"admin_username"`
+	AdminPassword		string		`yaml:"admin_password"`
 	LogLevel		string		`yaml:"log_level"`
 	CloudFoundryApi 	string          `yaml:"cf_api_url"`
 	CloudFoundryUsername 	string          `yaml:"cf_username"`
@@ -40,6 +44,20 @@ func LoadConfig(configFile string) (config *Config, err error) {
 		return config, err
 	}
 
+	if config.ServiceConfig.ServiceOrg == "" {
+		config.ServiceConfig.ServiceOrg = "system"
+	}
+
+	//bosh dns, which resolves apps.internal inside the containers
+	if config.ServiceConfig.InternalResolver == "" {
+		config.ServiceConfig.InternalResolver = "169.254.0.2"
+	}
+
+	//the gorouter and the load balancers in front of it
+	if len(config.ServiceConfig.TrustedProxies) == 0 {
+		config.ServiceConfig.TrustedProxies = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+	}
+
 	if err = config.Validate(); err != nil {
 		return config, fmt.Errorf("Validating config contents: %s", err)
 	}
@@ -61,5 +79,27 @@ func (c Config) Validate() error {
 		return errors.New("Must provide a non-empty Password")
 	}
 
+	if c.AdminUsername != "" && c.AdminUsername == c.Username {
+		return errors.New("Must provide an admin_username other than the broker Username")
+	}
+
+	if c.ServiceConfig.ServiceSpace == "" {
+		return errors.New("Must provide a non-empty service_space")
+	}
+
+	if c.ServiceConfig.SyslogDrainUrl != "" {
+		if err := route.ValidateSyslogDrainUrl(c.ServiceConfig.SyslogDrainUrl); err != nil {
+			return err
+		}
+	}
+
+	for _, service := range c.ServiceConfig.Services {
+		for _, plan := range service.Plans {
+			if _, err := regexp.Compile(plan.AllowedHostPattern); err != nil {
+				return fmt.Errorf("Plan %s allowed_host_pattern: %s", plan.Name, err)
+			}
+		}
+	}
+
 	return nil
 }
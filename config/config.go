@@ -8,7 +8,11 @@ type Config struct {
 	NginxBackendInstanceNum      int                `yaml:"per_nginx_backend_instance_num"`
 	StoreDataDir		     string		`yaml:"store_data_dir"`
 	TemplateDir                  string             `yaml:"template_dir"`
+	ServiceOrg                   string             `yaml:"service_org"`
 	ServiceSpace                 string             `yaml:"service_space"`
+	InternalResolver             string             `yaml:"internal_resolver"`
+	TrustedProxies               []string           `yaml:"trusted_proxies"`
+	SyslogDrainUrl               string             `yaml:"syslog_drain_url"`
 	Services                     []Service 		`yaml:"services"`
 }
 
@@ -54,6 +58,9 @@ type Plan struct {
 	Bindable    		*bool			`yaml:"bindable"`
 	EnableSystemSpace       bool                    `yaml:"use_system_space"`
 	InstanceConfig          ServiceInstanceConfig   `yaml:"instance_config"`
+	AllowedHostPattern      string                  `yaml:"allowed_host_pattern"`
+	ReservedHosts           []string                `yaml:"reserved_hosts"`
+	ProxyLimits             ProxyLimits             `yaml:"proxy_limits"`
 	Metadata    		PlanMetadata		`yaml:"metadata"`
 }
 
@@ -62,6 +69,14 @@ type ServiceInstanceConfig struct {
 	Memory			int                     `yaml:"memory"`
 	Disk 			int                     `yaml:"disk"`
 	Buildpack		string                  `yaml:"buildpack"`
+	StickyModule		bool                    `yaml:"sticky_module"`
+}
+
+// ProxyLimits caps the proxy settings of the service instances and bindings of a plan, zero is no cap
+type ProxyLimits struct {
+	MaxTimeout		int			`yaml:"max_timeout"`
+	MaxClientBodySize	int			`yaml:"max_client_body_size_mb"`
+	MaxKeepalive		int			`yaml:"max_keepalive"`
 }
 
 type PlanMetadata struct {
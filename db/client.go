@@ -7,11 +7,42 @@ import (
 	"database/sql"
 	"fmt"
 	"time"
+	"strings"
 	"encoding/json"
 	"github.com/wdxxs2z/nginx-flow-osb/route"
 	"os"
 )
 
+type BindingOperation struct {
+	BindingId		string
+	ServiceInstanceId	string
+	State			string
+	Description		string
+	StartedAt		time.Time
+}
+
+// Deployment is a push of the nginx application of a service instance, with the checksum of the
+// template and the hash of the nginx config it was rendered to
+type Deployment struct {
+	Id			int64
+	ServiceInstanceId	string
+	Operation		string
+	AppGuid			string
+	DropletGuid		string
+	TemplateChecksum	string
+	ConfigHash		string
+	CreatedAt		time.Time
+}
+
+// Revision is a stored version of the details of a service instance, every write of the
+// details adds the next revision
+type Revision struct {
+	ServiceInstanceId	string
+	Revision		int
+	NginxService		route.NginxService
+	CreatedAt		time.Time
+}
+
 type DBClient struct {
 	client		*sql.DB
 	logger          lager.Logger
@@ -50,10 +81,127 @@ func (c *DBClient) MigrateServiceInstanceTable() error {
 	baseCreateTable := "CREATE TABLE IF NOT EXISTS service_instance (" +
 		"id int NOT NULL AUTO_INCREMENT, PRIMARY KEY (id)" +
 		", service_instance_id varchar(42) NOT NULL" +
-		", service_instance_details BLOB NOT NULL" +
+		", service_instance_details MEDIUMBLOB NOT NULL" +
 		", space_id varchar(42) NOT NULL" +
+		", plan_id varchar(42) NOT NULL DEFAULT ''" +
                 ");"
 	_, err := c.client.Exec(baseCreateTable)
+	if err != nil {
+		return err
+	}
+	//tables created before the plan was stored
+	planColumnExist, err := c.columnExists("service_instance", "plan_id")
+	if err != nil {
+		return err
+	}
+	if planColumnExist == false {
+		if _, err := c.client.Exec("ALTER TABLE service_instance ADD COLUMN plan_id varchar(42) NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+	return c.widenDetailsColumn("service_instance")
+}
+
+func (c *DBClient) MigrateBindingOperationTable() error {
+	baseCreateTable := "CREATE TABLE IF NOT EXISTS service_binding_operation (" +
+		"id int NOT NULL AUTO_INCREMENT, PRIMARY KEY (id)" +
+		", service_binding_id varchar(42) NOT NULL" +
+		", service_instance_id varchar(42) NOT NULL" +
+		", state varchar(16) NOT NULL" +
+		", description varchar(1024) NOT NULL" +
+		", started_at bigint NOT NULL DEFAULT 0" +
+		", UNIQUE INDEX service_binding_id (service_binding_id)" +
+		");"
+	_, err := c.client.Exec(baseCreateTable)
+	if err != nil {
+		return err
+	}
+	//tables created before the start of the operations was stored, their operations count as stale
+	startedColumnExist, err := c.columnExists("service_binding_operation", "started_at")
+	if err != nil {
+		return err
+	}
+	if startedColumnExist == false {
+		if _, err := c.client.Exec("ALTER TABLE service_binding_operation ADD COLUMN started_at bigint NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+	//and before a binding had one operation at most, the last one is kept
+	indexExist, err := c.rowExists("SELECT 1 FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?", "service_binding_operation", "service_binding_id")
+	if err != nil {
+		return err
+	}
+	if indexExist == false {
+		if _, err := c.client.Exec("DELETE o FROM service_binding_operation o JOIN service_binding_operation newer ON o.service_binding_id = newer.service_binding_id AND o.id < newer.id"); err != nil {
+			return err
+		}
+		if _, err := c.client.Exec("ALTER TABLE service_binding_operation ADD UNIQUE INDEX service_binding_id (service_binding_id)"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *DBClient) MigrateDeploymentTable() error {
+	baseCreateTable := "CREATE TABLE IF NOT EXISTS service_instance_deployment (" +
+		"id int NOT NULL AUTO_INCREMENT, PRIMARY KEY (id)" +
+		", service_instance_id varchar(42) NOT NULL" +
+		", operation varchar(32) NOT NULL" +
+		", app_guid varchar(42) NOT NULL DEFAULT ''" +
+		", droplet_guid varchar(42) NOT NULL DEFAULT ''" +
+		", template_checksum varchar(64) NOT NULL DEFAULT ''" +
+		", config_hash varchar(64) NOT NULL DEFAULT ''" +
+		", created_at bigint NOT NULL" +
+		", INDEX (service_instance_id)" +
+		");"
+	_, err := c.client.Exec(baseCreateTable)
+	if err != nil {
+		return err
+	}
+	//tables created before the deployed versions were stored
+	for _, column := range []string{"app_guid varchar(42)", "droplet_guid varchar(42)", "template_checksum varchar(64)", "config_hash varchar(64)"} {
+		name := strings.Fields(column)[0]
+		columnExist, err := c.columnExists("service_instance_deployment", name)
+		if err != nil {
+			return err
+		}
+		if columnExist == false {
+			if _, err := c.client.Exec("ALTER TABLE service_instance_deployment ADD COLUMN " + column + " NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *DBClient) MigrateRevisionTable() error {
+	baseCreateTable := "CREATE TABLE IF NOT EXISTS service_instance_revision (" +
+		"id int NOT NULL AUTO_INCREMENT, PRIMARY KEY (id)" +
+		", service_instance_id varchar(42) NOT NULL" +
+		", revision int NOT NULL" +
+		", service_instance_details MEDIUMBLOB NOT NULL" +
+		", created_at bigint NOT NULL" +
+		", UNIQUE INDEX (service_instance_id, revision)" +
+		");"
+	_, err := c.client.Exec(baseCreateTable)
+	if err != nil {
+		return err
+	}
+	if err := c.widenDetailsColumn("service_instance_revision"); err != nil {
+		return err
+	}
+	//the service instances created before the revisions start with their current details
+	_, err = c.client.Exec("INSERT INTO service_instance_revision(service_instance_id,revision,service_instance_details,created_at) SELECT service_instance_id, 1, service_instance_details, ? FROM service_instance WHERE service_instance_id NOT IN (SELECT service_instance_id FROM service_instance_revision)", time.Now().Unix())
+	return err
+}
+
+func (c *DBClient) MigrateBrokerStateTable() error {
+	baseCreateTable := "CREATE TABLE IF NOT EXISTS broker_state (" +
+		"state_key varchar(64) NOT NULL, PRIMARY KEY (state_key)" +
+		", state_value MEDIUMBLOB NOT NULL" +
+		", updated_at bigint NOT NULL" +
+		");"
+	_, err := c.client.Exec(baseCreateTable)
 	return err
 }
 
@@ -68,15 +216,25 @@ func (c *DBClient) ExistServiceInstance(serviceInstanceId string) (bool, error){
 	return exist, nil
 }
 
-func (c *DBClient) CreateServiceInstance(serviceInstanceId string, serviceDetails []byte, spaceGuid string) (error) {
+func (c *DBClient) CreateServiceInstance(serviceInstanceId string, planId string, serviceDetails []byte, spaceGuid string) (error) {
 	c.logger.Debug("create-db-instance", lager.Data{
 		"instance_id":		serviceInstanceId,
+		"plan_id":		planId,
 	})
-	_, err := c.client.Exec("INSERT INTO service_instance(service_instance_id,service_instance_details,space_id) VALUES(?,?,?)", serviceInstanceId, serviceDetails, spaceGuid)
+	tx, err := c.client.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
+	_, err = tx.Exec("INSERT INTO service_instance(service_instance_id,service_instance_details,space_id,plan_id) VALUES(?,?,?,?)", serviceInstanceId, serviceDetails, spaceGuid, planId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := createRevision(tx, serviceInstanceId, serviceDetails); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
 func (c *DBClient) DeleteServiceInstance(serviceInstanceId string) (error) {
@@ -90,6 +248,24 @@ func (c *DBClient) DeleteServiceInstance(serviceInstanceId string) (error) {
 	return nil
 }
 
+func (c *DBClient) ListServiceInstanceIds() ([]string, error) {
+	c.logger.Debug("list-db-instance-ids", lager.Data{})
+	rows, err := c.client.Query("SELECT service_instance_id FROM service_instance ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
 func (c *DBClient) GetSpaceWithServiceId(serviceInstanceId string) (string, error) {
 	c.logger.Debug("get-db-space-with-service", lager.Data{
 		"instance_id":		serviceInstanceId,
@@ -101,15 +277,117 @@ func (c *DBClient) GetSpaceWithServiceId(serviceInstanceId string) (string, erro
 	return spaceId, nil
 }
 
+func (c *DBClient) UpdateServiceInstanceSpace(serviceInstanceId string, spaceGuid string) (error){
+	c.logger.Debug("update-db-instance-space", lager.Data{
+		"instance_id":		serviceInstanceId,
+		"space_id":		spaceGuid,
+	})
+	_, err := c.client.Exec("UPDATE service_instance SET space_id = ? WHERE service_instance_id = ?", spaceGuid, serviceInstanceId)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *DBClient) GetPlanWithServiceId(serviceInstanceId string) (string, error) {
+	c.logger.Debug("get-db-plan-with-service", lager.Data{
+		"instance_id":		serviceInstanceId,
+	})
+	var planId string
+	if err := c.client.QueryRow("SELECT plan_id FROM service_instance WHERE service_instance_id = ?", serviceInstanceId).Scan(&planId); err != nil {
+		return "", err
+	}
+	return planId, nil
+}
+
+func (c *DBClient) UpdateServiceInstancePlan(serviceInstanceId string, planId string) (error){
+	c.logger.Debug("update-db-instance-plan", lager.Data{
+		"instance_id":		serviceInstanceId,
+		"plan_id":		planId,
+	})
+	_, err := c.client.Exec("UPDATE service_instance SET plan_id = ? WHERE service_instance_id = ?", planId, serviceInstanceId)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 func (c *DBClient) UpdateServiceInstance(serviceInstanceId string, serviceDetails []byte) (error){
 	c.logger.Debug("update-db-instance", lager.Data{
 		"instance_id":		serviceInstanceId,
 	})
-	stmt , err := c.client.Prepare("UPDATE service_instance SET service_instance_details = ? WHERE service_instance_id = ?")
+	tx, err := c.client.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE service_instance SET service_instance_details = ? WHERE service_instance_id = ?", serviceDetails, serviceInstanceId)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
-	_, err = stmt.Exec(serviceDetails, serviceInstanceId)
+	if err := createRevision(tx, serviceInstanceId, serviceDetails); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//the writes of a service instance are serialized by the broker, the next revision is not raced
+func createRevision(tx *sql.Tx, serviceInstanceId string, serviceDetails []byte) error {
+	_, err := tx.Exec("INSERT INTO service_instance_revision(service_instance_id,revision,service_instance_details,created_at) SELECT ?, COALESCE(MAX(revision), 0) + 1, ?, ? FROM service_instance_revision WHERE service_instance_id = ?", serviceInstanceId, serviceDetails, time.Now().Unix(), serviceInstanceId)
+	return err
+}
+
+// ListRevisions returns the last revisions of a service instance, the newest first
+func (c *DBClient) ListRevisions(serviceInstanceId string, limit int) ([]Revision, error) {
+	c.logger.Debug("list-db-revisions", lager.Data{
+		"instance_id":		serviceInstanceId,
+	})
+	rows, err := c.client.Query("SELECT revision, service_instance_details, created_at FROM service_instance_revision WHERE service_instance_id = ? ORDER BY revision DESC LIMIT ?", serviceInstanceId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revisions := make([]Revision, 0)
+	for rows.Next() {
+		revision, err := scanRevision(serviceInstanceId, rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, rows.Err()
+}
+
+// GetRevision returns sql.ErrNoRows when the service instance has no such revision
+func (c *DBClient) GetRevision(serviceInstanceId string, revision int) (Revision, error) {
+	c.logger.Debug("get-db-revision", lager.Data{
+		"instance_id":		serviceInstanceId,
+		"revision":		revision,
+	})
+	row := c.client.QueryRow("SELECT revision, service_instance_details, created_at FROM service_instance_revision WHERE service_instance_id = ? AND revision = ?", serviceInstanceId, revision)
+	return scanRevision(serviceInstanceId, row)
+}
+
+func scanRevision(serviceInstanceId string, row interface{ Scan(...interface{}) error }) (Revision, error) {
+	revision := Revision{ServiceInstanceId: serviceInstanceId}
+	var serviceDetailsBlob []byte
+	var createdAt int64
+	if err := row.Scan(&revision.Revision, &serviceDetailsBlob, &createdAt); err != nil {
+		return Revision{}, err
+	}
+	if err := json.Unmarshal(serviceDetailsBlob, &revision.NginxService); err != nil {
+		return Revision{}, err
+	}
+	revision.CreatedAt = time.Unix(createdAt, 0)
+	return revision, nil
+}
+
+func (c *DBClient) DeleteRevisions(serviceInstanceId string) (error) {
+	c.logger.Debug("delete-db-revisions", lager.Data{
+		"instance_id":		serviceInstanceId,
+	})
+	_, err := c.client.Exec("DELETE FROM service_instance_revision WHERE service_instance_id = ?", serviceInstanceId)
 	if err != nil {
 		return err
 	}
@@ -133,6 +411,192 @@ func (c *DBClient) GetServiceInstance(serviceInstanceId string) (route.NginxServ
 	return serviceDetails, nil
 }
 
+func (c *DBClient) CreateBindingOperation(operation BindingOperation) (error) {
+	c.logger.Debug("create-db-binding-operation", lager.Data{
+		"binding_id":		operation.BindingId,
+		"instance_id":		operation.ServiceInstanceId,
+	})
+	_, err := c.client.Exec("INSERT INTO service_binding_operation(service_binding_id,service_instance_id,state,description,started_at) VALUES(?,?,?,?,?)", operation.BindingId, operation.ServiceInstanceId, operation.State, operation.Description, operation.StartedAt.Unix())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *DBClient) UpdateBindingOperation(bindingId, state, description string) (error) {
+	c.logger.Debug("update-db-binding-operation", lager.Data{
+		"binding_id":		bindingId,
+		"state":		state,
+	})
+	_, err := c.client.Exec("UPDATE service_binding_operation SET state = ?, description = ? WHERE service_binding_id = ?", state, description, bindingId)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetBindingOperation returns an empty operation when the binding has no async operation
+func (c *DBClient) GetBindingOperation(bindingId string) (BindingOperation, error) {
+	c.logger.Debug("get-db-binding-operation", lager.Data{
+		"binding_id":		bindingId,
+	})
+	operation := BindingOperation{
+		BindingId:	bindingId,
+	}
+	var startedAt int64
+	err := c.client.QueryRow("SELECT service_instance_id, state, description, started_at FROM service_binding_operation WHERE service_binding_id = ?", bindingId).Scan(&operation.ServiceInstanceId, &operation.State, &operation.Description, &startedAt)
+	if err == sql.ErrNoRows {
+		return BindingOperation{}, nil
+	}
+	if err != nil {
+		return BindingOperation{}, err
+	}
+	operation.StartedAt = time.Unix(startedAt, 0)
+	return operation, nil
+}
+
+// FailBindingOperations fails the binding operations in progress since before startedBefore
+func (c *DBClient) FailBindingOperations(inProgress, failed, description string, startedBefore time.Time) (int64, error) {
+	c.logger.Debug("fail-db-binding-operations", lager.Data{
+		"started_before":	startedBefore,
+	})
+	result, err := c.client.Exec("UPDATE service_binding_operation SET state = ?, description = ? WHERE state = ? AND started_at < ?", failed, description, inProgress, startedBefore.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (c *DBClient) DeleteBindingOperation(bindingId string) (error) {
+	c.logger.Debug("delete-db-binding-operation", lager.Data{
+		"binding_id":		bindingId,
+	})
+	_, err := c.client.Exec("DELETE FROM service_binding_operation WHERE service_binding_id = ?", bindingId)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *DBClient) CreateDeployment(deployment Deployment) (error) {
+	c.logger.Debug("create-db-deployment", lager.Data{
+		"instance_id":		deployment.ServiceInstanceId,
+		"operation":		deployment.Operation,
+	})
+	_, err := c.client.Exec("INSERT INTO service_instance_deployment(service_instance_id,operation,app_guid,droplet_guid,template_checksum,config_hash,created_at) VALUES(?,?,?,?,?,?,?)", deployment.ServiceInstanceId, deployment.Operation, deployment.AppGuid, deployment.DropletGuid, deployment.TemplateChecksum, deployment.ConfigHash, deployment.CreatedAt.Unix())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ListDeployments returns the last deployments of a service instance, the newest first
+func (c *DBClient) ListDeployments(serviceInstanceId string, limit int) ([]Deployment, error) {
+	c.logger.Debug("list-db-deployments", lager.Data{
+		"instance_id":		serviceInstanceId,
+	})
+	rows, err := c.client.Query("SELECT id, operation, app_guid, droplet_guid, template_checksum, config_hash, created_at FROM service_instance_deployment WHERE service_instance_id = ? ORDER BY id DESC LIMIT ?", serviceInstanceId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deployments := make([]Deployment, 0)
+	for rows.Next() {
+		deployment := Deployment{ServiceInstanceId: serviceInstanceId}
+		var createdAt int64
+		if err := rows.Scan(&deployment.Id, &deployment.Operation, &deployment.AppGuid, &deployment.DropletGuid, &deployment.TemplateChecksum, &deployment.ConfigHash, &createdAt); err != nil {
+			return nil, err
+		}
+		deployment.CreatedAt = time.Unix(createdAt, 0)
+		deployments = append(deployments, deployment)
+	}
+	return deployments, rows.Err()
+}
+
+func (c *DBClient) DeleteDeployments(serviceInstanceId string) (error) {
+	c.logger.Debug("delete-db-deployments", lager.Data{
+		"instance_id":		serviceInstanceId,
+	})
+	_, err := c.client.Exec("DELETE FROM service_instance_deployment WHERE service_instance_id = ?", serviceInstanceId)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteOrphanBindingOperations deletes the binding operations of the service instances no longer stored
+func (c *DBClient) DeleteOrphanBindingOperations() (int64, error) {
+	c.logger.Debug("delete-db-orphan-binding-operations", lager.Data{})
+	result, err := c.client.Exec("DELETE FROM service_binding_operation WHERE service_instance_id NOT IN (SELECT service_instance_id FROM service_instance)")
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteOrphanDeployments deletes the deployment history of the service instances no longer stored
+func (c *DBClient) DeleteOrphanDeployments() (int64, error) {
+	c.logger.Debug("delete-db-orphan-deployments", lager.Data{})
+	result, err := c.client.Exec("DELETE FROM service_instance_deployment WHERE service_instance_id NOT IN (SELECT service_instance_id FROM service_instance)")
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteOrphanRevisions deletes the revisions of the service instances no longer stored
+func (c *DBClient) DeleteOrphanRevisions() (int64, error) {
+	c.logger.Debug("delete-db-orphan-revisions", lager.Data{})
+	result, err := c.client.Exec("DELETE FROM service_instance_revision WHERE service_instance_id NOT IN (SELECT service_instance_id FROM service_instance)")
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetBrokerState returns nil when the state was never saved
+func (c *DBClient) GetBrokerState(key string) ([]byte, error) {
+	c.logger.Debug("get-db-broker-state", lager.Data{
+		"key":			key,
+	})
+	var value []byte
+	err := c.client.QueryRow("SELECT state_value FROM broker_state WHERE state_key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (c *DBClient) SaveBrokerState(key string, value []byte) (error) {
+	c.logger.Debug("save-db-broker-state", lager.Data{
+		"key":			key,
+	})
+	_, err := c.client.Exec("REPLACE INTO broker_state(state_key,state_value,updated_at) VALUES(?,?,?)", key, value, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+//a BLOB holds 64KB, less than the details with their error pages
+func (c *DBClient)widenDetailsColumn(table string) error {
+	blob, err := c.rowExists("SELECT 1 FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ? AND data_type = ?", table, "service_instance_details", "blob")
+	if err != nil {
+		return err
+	}
+	if blob {
+		_, err = c.client.Exec("ALTER TABLE " + table + " MODIFY service_instance_details MEDIUMBLOB NOT NULL")
+	}
+	return err
+}
+
+func (c *DBClient)columnExists(table, column string) (bool, error) {
+	return c.rowExists("SELECT 1 FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?", table, column)
+}
+
 func (c *DBClient)rowExists(query string, args ...interface{}) (bool , error) {
 	var exists bool
 	query = fmt.Sprintf("SELECT exists (%s)", query)
@@ -55,6 +55,12 @@ func main() {
 
 	os.Setenv("USERNAME", config.Username)
 	os.Setenv("PASSWORD", config.Password)
+	if os.Getenv("ADMIN_USERNAME") == "" {
+		os.Setenv("ADMIN_USERNAME", config.AdminUsername)
+	}
+	if os.Getenv("ADMIN_PASSWORD") == "" {
+		os.Setenv("ADMIN_PASSWORD", config.AdminPassword)
+	}
 
 	prepareEnvironment(config)
 
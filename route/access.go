@@ -0,0 +1,128 @@
+package route
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+)
+
+// Access restricts the clients by address, taken from X-Forwarded-For, and by http basic auth
+type Access struct {
+	Allow           []string                        `json:"allow,omitempty"`
+	Deny            []string                        `json:"deny,omitempty"`
+	Realm           string                          `json:"realm,omitempty"`
+	BasicAuth       []BasicAuthUser                 `json:"basic_auth,omitempty"`
+}
+
+// BasicAuthUser hashes come only from the stored service instance, never from the parameters
+type BasicAuthUser struct {
+	Username        string                          `json:"username"`
+	Password        string                          `json:"password,omitempty"`
+	Hash            string                          `json:"hash,omitempty"`
+}
+
+// HtpasswdFile is written next to nginx.conf, the dot keeps it out of the static root
+const HtpasswdFile = ".htpasswd"
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]+$`)
+
+//the sha512 crypt hashes of HashPasswords, and the salted sha1 hashes it made before
+var hashPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^\$6\$[./0-9A-Za-z]{16}\$[./0-9A-Za-z]{86}$`),
+	regexp.MustCompile(`^\{SSHA\}[A-Za-z0-9+/]{38}==$`),
+}
+
+func (a Access) Validate() error {
+	for _, address := range append(append([]string{}, a.Allow...), a.Deny...) {
+		if net.ParseIP(address) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(address); err != nil {
+			return fmt.Errorf("access address %s must be an ip or a cidr", address)
+		}
+	}
+	if !safeValue(a.Realm) {
+		return fmt.Errorf("access realm must not contain quotes, backslashes or control characters")
+	}
+	usernames := make(map[string]bool)
+	for _, user := range a.BasicAuth {
+		if !usernamePattern.MatchString(user.Username) {
+			return fmt.Errorf("basic auth username %q must use letters, digits, ., _, @ or -", user.Username)
+		}
+		if usernames[user.Username] {
+			return fmt.Errorf("basic auth username %s is duplicated", user.Username)
+		}
+		usernames[user.Username] = true
+		if user.Password == "" && user.Hash == "" {
+			return fmt.Errorf("basic auth user %s has no password", user.Username)
+		}
+		if user.Password == "" && !validHash(user.Hash) {
+			return fmt.Errorf("basic auth user %s has an invalid password hash", user.Username)
+		}
+	}
+	return nil
+}
+
+func (a Access) Restricted() bool {
+	return len(a.Allow) > 0 || len(a.Deny) > 0
+}
+
+func (a Access) AuthRealm() string {
+	if a.Realm == "" {
+		return "Restricted"
+	}
+	return a.Realm
+}
+
+// HashPasswords replaces the plain text passwords with sha512 crypt hashes, nginx checks them with the crypt of the stack
+func (a *Access) HashPasswords() error {
+	for i, user := range a.BasicAuth {
+		if user.Password == "" {
+			continue
+		}
+		salt, err := cryptSalt()
+		if err != nil {
+			return err
+		}
+		a.BasicAuth[i].Hash = sha512Crypt(user.Password, salt)
+		a.BasicAuth[i].Password = ""
+	}
+	return nil
+}
+
+// KeepStoredHashes drops the hashes of the parameters, the users without password get their stored hash
+func (a *Access) KeepStoredHashes(stored Access) {
+	for i, user := range a.BasicAuth {
+		a.BasicAuth[i].Hash = ""
+		if user.Password != "" {
+			continue
+		}
+		for _, storedUser := range stored.BasicAuth {
+			if storedUser.Username == user.Username {
+				a.BasicAuth[i].Hash = storedUser.Hash
+			}
+		}
+	}
+}
+
+func validHash(hash string) bool {
+	for _, pattern := range hashPatterns {
+		if pattern.MatchString(hash) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a Access) Htpasswd() []byte {
+	var buffer bytes.Buffer
+	for _, user := range a.BasicAuth {
+		buffer.WriteString(user.Username + ":" + user.Hash + "\n")
+	}
+	return buffer.Bytes()
+}
+
+func (ns NginxService) HtpasswdFile() string {
+	return HtpasswdFile
+}
@@ -0,0 +1,108 @@
+package route
+
+import (
+	"strings"
+	"testing"
+)
+
+var (
+	validCryptHash = sha512Crypt("secret", "0123456789abcdef")
+	validSSHAHash  = "{SSHA}" + strings.Repeat("A", 38) + "=="
+)
+
+func TestAccessValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		access Access
+		valid  bool
+	}{
+		{"empty", Access{}, true},
+		{"addresses", Access{Allow: []string{"10.0.0.1", "192.168.0.0/16"}, Deny: []string{"::1"}}, true},
+		{"invalid address", Access{Allow: []string{"10.0.0"}}, false},
+		{"invalid cidr", Access{Deny: []string{"10.0.0.0/33"}}, false},
+		{"realm", Access{Realm: "Staff only"}, true},
+		{"realm quote", Access{Realm: `Staff "only"`}, false},
+		{"realm backslash", Access{Realm: `Staff\only`}, false},
+		{"realm control character", Access{Realm: "Staff\nonly"}, false},
+		{"password", Access{BasicAuth: []BasicAuthUser{{Username: "alice@example.com", Password: "secret"}}}, true},
+		{"crypt hash", Access{BasicAuth: []BasicAuthUser{{Username: "alice", Hash: validCryptHash}}}, true},
+		{"ssha hash", Access{BasicAuth: []BasicAuthUser{{Username: "alice", Hash: validSSHAHash}}}, true},
+		{"username space", Access{BasicAuth: []BasicAuthUser{{Username: "alice smith", Password: "secret"}}}, false},
+		{"username colon", Access{BasicAuth: []BasicAuthUser{{Username: "alice:x", Password: "secret"}}}, false},
+		{"username empty", Access{BasicAuth: []BasicAuthUser{{Password: "secret"}}}, false},
+		{"username duplicated", Access{BasicAuth: []BasicAuthUser{{Username: "alice", Password: "a"}, {Username: "alice", Password: "b"}}}, false},
+		{"no password", Access{BasicAuth: []BasicAuthUser{{Username: "alice"}}}, false},
+		{"plain text hash", Access{BasicAuth: []BasicAuthUser{{Username: "alice", Hash: "secret"}}}, false},
+		{"hash newline", Access{BasicAuth: []BasicAuthUser{{Username: "alice", Hash: validCryptHash + "\nbob:secret"}}}, false},
+		{"short salt crypt hash", Access{BasicAuth: []BasicAuthUser{{Username: "alice", Hash: sha512Crypt("secret", "salt")}}}, false},
+		{"md5 hash", Access{BasicAuth: []BasicAuthUser{{Username: "alice", Hash: "$apr1$salt$" + strings.Repeat("a", 22)}}}, false},
+		{"short crypt hash", Access{BasicAuth: []BasicAuthUser{{Username: "alice", Hash: "$6$salt$" + strings.Repeat("a", 86)}}}, false},
+	}
+	for _, test := range tests {
+		err := test.access.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestKeepStoredHashes(t *testing.T) {
+	stored := Access{BasicAuth: []BasicAuthUser{{Username: "alice", Hash: validCryptHash}, {Username: "carol", Hash: validSSHAHash}}}
+	access := Access{BasicAuth: []BasicAuthUser{
+		{Username: "alice"},
+		{Username: "bob", Hash: validCryptHash},
+		{Username: "carol", Password: "secret", Hash: validCryptHash},
+	}}
+	access.KeepStoredHashes(stored)
+	expected := []BasicAuthUser{
+		{Username: "alice", Hash: validCryptHash},
+		{Username: "bob"},
+		{Username: "carol", Password: "secret"},
+	}
+	for i, user := range access.BasicAuth {
+		if user != expected[i] {
+			t.Errorf("user %s: got %+v, expected %+v", user.Username, user, expected[i])
+		}
+	}
+	//a user the stored service instance does not know has to give a password
+	if err := access.Validate(); err == nil {
+		t.Errorf("expected an error for the user with a hash of the parameters")
+	}
+}
+
+func TestHashPasswords(t *testing.T) {
+	access := Access{BasicAuth: []BasicAuthUser{{Username: "alice", Password: "secret"}, {Username: "bob", Hash: validCryptHash}}}
+	if err := access.HashPasswords(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	alice := access.BasicAuth[0]
+	if alice.Password != "" {
+		t.Errorf("the password of alice is kept")
+	}
+	if !validHash(alice.Hash) || !strings.HasPrefix(alice.Hash, "$6$") {
+		t.Fatalf("the hash %s of alice is not a sha512 crypt hash", alice.Hash)
+	}
+	if hash := sha512Crypt("secret", alice.Hash[3:19]); hash != alice.Hash || hash == validCryptHash {
+		t.Errorf("the hash %s of alice does not match %s", alice.Hash, hash)
+	}
+	if access.BasicAuth[1].Hash != validCryptHash {
+		t.Errorf("the hash of bob changed to %s", access.BasicAuth[1].Hash)
+	}
+	if err := access.Validate(); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	access := Access{BasicAuth: []BasicAuthUser{{Username: "alice", Hash: validCryptHash}, {Username: "bob", Hash: validSSHAHash}}}
+	expected := "alice:" + validCryptHash + "\nbob:" + validSSHAHash + "\n"
+	if htpasswd := string(access.Htpasswd()); htpasswd != expected {
+		t.Errorf("got %q, expected %q", htpasswd, expected)
+	}
+	if htpasswd := (Access{}).Htpasswd(); len(htpasswd) != 0 {
+		t.Errorf("got %q without users", htpasswd)
+	}
+}
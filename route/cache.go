@@ -0,0 +1,153 @@
+package route
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Cache lives on the disk of the nginx application, a zero MaxSize or no rules disables it
+type Cache struct {
+	MaxSize         int                             `json:"max_size_mb"`
+	KeysZoneSize    int                             `json:"keys_zone_mb,omitempty"`
+	Inactive        string                          `json:"inactive,omitempty"`
+	Key             []string                        `json:"key,omitempty"`
+	BypassHeaders   []string                        `json:"bypass_headers,omitempty"`
+	Rules           []CacheRule                     `json:"rules,omitempty"`
+}
+
+// CacheRule caches the responses under a path prefix, Valid maps a status code (or any) to its ttl
+type CacheRule struct {
+	Path            string                          `json:"path"`
+	Valid           map[string]string               `json:"valid"`
+}
+
+type CacheLocation struct {
+	Path            string
+	Zone            string
+	Key             string
+	Bypass          string
+	Valid           []CacheValid
+}
+
+type CacheValid struct {
+	Status          string
+	TTL             string
+}
+
+var (
+	cachePathPattern   = regexp.MustCompile(`^/[A-Za-z0-9._~/-]*$`)
+	cacheTTLPattern    = regexp.MustCompile(`^[0-9]+[smhd]$`)
+	cacheStatusPattern = regexp.MustCompile(`^(any|[1-5][0-9][0-9])$`)
+	cacheKeyPattern    = regexp.MustCompile(`^(scheme|host|request_uri|uri|args|request_method|(http|cookie|arg)_[a-z0-9_]+)$`)
+	defaultCacheKey    = []string{"scheme", "request_method", "host", "request_uri"}
+)
+
+func (c Cache) Validate() error {
+	if c.MaxSize < 0 || c.KeysZoneSize < 0 {
+		return fmt.Errorf("cache sizes must not be negative")
+	}
+	//only the rule locations use the cache
+	if c.MaxSize > 0 && len(c.Rules) == 0 {
+		return fmt.Errorf("cache max_size_mb needs at least one rule")
+	}
+	if c.Inactive != "" && !cacheTTLPattern.MatchString(c.Inactive) {
+		return fmt.Errorf("cache inactive %s must be a number followed by s, m, h or d", c.Inactive)
+	}
+	for _, part := range c.Key {
+		if !cacheKeyPattern.MatchString(part) {
+			return fmt.Errorf("cache key part %s is not supported", part)
+		}
+	}
+	for _, header := range c.BypassHeaders {
+		if !headerNamePattern.MatchString(header) {
+			return fmt.Errorf("cache bypass header %q is invalid", header)
+		}
+	}
+	paths := make(map[string]bool)
+	for _, rule := range c.Rules {
+		if !cachePathPattern.MatchString(rule.Path) {
+			return fmt.Errorf("cache rule path %s must start with / and use letters, digits, ., _, ~, / or -", rule.Path)
+		}
+		if paths[rule.Path] {
+			return fmt.Errorf("cache rule path %s is duplicated", rule.Path)
+		}
+		paths[rule.Path] = true
+		if len(rule.Valid) == 0 {
+			return fmt.Errorf("cache rule %s has no valid status", rule.Path)
+		}
+		for status, ttl := range rule.Valid {
+			if !cacheStatusPattern.MatchString(status) {
+				return fmt.Errorf("cache rule %s status %s must be a status code or any", rule.Path, status)
+			}
+			if !cacheTTLPattern.MatchString(ttl) {
+				return fmt.Errorf("cache rule %s ttl %s must be a number followed by s, m, h or d", rule.Path, ttl)
+			}
+		}
+	}
+	return nil
+}
+
+func (c Cache) Enabled() bool {
+	//the instances stored before rules were required may have a size without rules
+	return c.MaxSize > 0 && len(c.Rules) > 0
+}
+
+func (ns NginxService) CacheDir() string {
+	return "/home/vcap/tmp/nginx-cache"
+}
+
+func (ns NginxService) CacheZone() string {
+	return "cache_" + strings.Replace(ns.ServiceId, "-", "_", -1)
+}
+
+func (ns NginxService) CacheKeysZoneSize() int {
+	if ns.Cache.KeysZoneSize == 0 {
+		return 10
+	}
+	return ns.Cache.KeysZoneSize
+}
+
+func (ns NginxService) CacheInactive() string {
+	if ns.Cache.Inactive == "" {
+		return "60m"
+	}
+	return ns.Cache.Inactive
+}
+
+// CacheLocations returns nothing when the cache is disabled or there is no backend to cache
+func (ns NginxService) CacheLocations() []CacheLocation {
+	if !ns.Cache.Enabled() || len(ns.HttpNginxs()) == 0 {
+		return nil
+	}
+	keyParts := ns.Cache.Key
+	if len(keyParts) == 0 {
+		keyParts = defaultCacheKey
+	}
+	key := ""
+	for _, part := range keyParts {
+		key += "$" + part
+	}
+	bypass := make([]string, 0)
+	for _, header := range ns.Cache.BypassHeaders {
+		bypass = append(bypass, "$http_" + strings.Replace(strings.ToLower(header), "-", "_", -1))
+	}
+	locations := make([]CacheLocation, 0)
+	for _, rule := range ns.Cache.Rules {
+		location := CacheLocation{
+			Path:   rule.Path,
+			Zone:   ns.CacheZone(),
+			Key:    key,
+			Bypass: strings.Join(bypass, " "),
+		}
+		for status, ttl := range rule.Valid {
+			location.Valid = append(location.Valid, CacheValid{Status: status, TTL: ttl})
+		}
+		sort.Slice(location.Valid, func(i, j int) bool {
+			return location.Valid[i].Status < location.Valid[j].Status
+		})
+		locations = append(locations, location)
+	}
+	return locations
+}
@@ -0,0 +1,79 @@
+package route
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCacheValidate(t *testing.T) {
+	rule := CacheRule{Path: "/static", Valid: map[string]string{"200": "10m"}}
+	tests := []struct {
+		name  string
+		cache Cache
+		valid bool
+	}{
+		{"disabled", Cache{}, true},
+		{"rule", Cache{MaxSize: 100, Rules: []CacheRule{rule}}, true},
+		{"negative size", Cache{MaxSize: -1, Rules: []CacheRule{rule}}, false},
+		{"negative keys zone", Cache{MaxSize: 100, KeysZoneSize: -1, Rules: []CacheRule{rule}}, false},
+		{"size without rules", Cache{MaxSize: 100}, false},
+		{"inactive", Cache{MaxSize: 100, Inactive: "2h", Rules: []CacheRule{rule}}, true},
+		{"inactive without unit", Cache{MaxSize: 100, Inactive: "2", Rules: []CacheRule{rule}}, false},
+		{"key", Cache{MaxSize: 100, Key: []string{"host", "uri", "cookie_session", "http_accept_language"}, Rules: []CacheRule{rule}}, true},
+		{"unknown key", Cache{MaxSize: 100, Key: []string{"remote_addr"}, Rules: []CacheRule{rule}}, false},
+		{"bypass header", Cache{MaxSize: 100, BypassHeaders: []string{"X-No-Cache"}, Rules: []CacheRule{rule}}, true},
+		{"invalid bypass header", Cache{MaxSize: 100, BypassHeaders: []string{"X No Cache"}, Rules: []CacheRule{rule}}, false},
+		{"relative path", Cache{MaxSize: 100, Rules: []CacheRule{{Path: "static", Valid: rule.Valid}}}, false},
+		{"path space", Cache{MaxSize: 100, Rules: []CacheRule{{Path: "/a b", Valid: rule.Valid}}}, false},
+		{"path brace", Cache{MaxSize: 100, Rules: []CacheRule{{Path: "/a{", Valid: rule.Valid}}}, false},
+		{"duplicated path", Cache{MaxSize: 100, Rules: []CacheRule{rule, rule}}, false},
+		{"no valid", Cache{MaxSize: 100, Rules: []CacheRule{{Path: "/static"}}}, false},
+		{"any status", Cache{MaxSize: 100, Rules: []CacheRule{{Path: "/", Valid: map[string]string{"any": "1d"}}}}, true},
+		{"invalid status", Cache{MaxSize: 100, Rules: []CacheRule{{Path: "/", Valid: map[string]string{"600": "1d"}}}}, false},
+		{"invalid ttl", Cache{MaxSize: 100, Rules: []CacheRule{{Path: "/", Valid: map[string]string{"200": "1w"}}}}, false},
+	}
+	for _, test := range tests {
+		err := test.cache.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestCacheLocations(t *testing.T) {
+	ns := NginxService{
+		ServiceId: "a-b",
+		Cache: Cache{
+			MaxSize:       100,
+			BypassHeaders: []string{"X-No-Cache"},
+			Rules:         []CacheRule{{Path: "/static", Valid: map[string]string{"404": "1m", "200": "10m"}}},
+		},
+		Nginxs: []Nginx{{Name: "app", Port: 8090}},
+	}
+	expected := []CacheLocation{{
+		Path:   "/static",
+		Zone:   "cache_a_b",
+		Key:    "$scheme$request_method$host$request_uri",
+		Bypass: "$http_x_no_cache",
+		Valid:  []CacheValid{{Status: "200", TTL: "10m"}, {Status: "404", TTL: "1m"}},
+	}}
+	if locations := ns.CacheLocations(); !reflect.DeepEqual(locations, expected) {
+		t.Errorf("got %+v, expected %+v", locations, expected)
+	}
+	ns.Cache.Key = []string{"host", "uri"}
+	if locations := ns.CacheLocations(); len(locations) != 1 || locations[0].Key != "$host$uri" {
+		t.Errorf("got %+v, expected the key $host$uri", locations)
+	}
+	ns.Nginxs = []Nginx{{Name: "app", Port: 8090, Role: RoleMirror}}
+	if locations := ns.CacheLocations(); locations != nil {
+		t.Errorf("got %+v without a backend to cache", locations)
+	}
+	ns.Nginxs = []Nginx{{Name: "app", Port: 8090}}
+	ns.Cache.Rules = nil
+	if locations := ns.CacheLocations(); locations != nil {
+		t.Errorf("got %+v without rules", locations)
+	}
+}
@@ -0,0 +1,118 @@
+package route
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+)
+
+//the alphabet of the crypt salts and hashes
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+//the 5000 default rounds of glibc, nginx runs them on every authenticated request
+const sha512CryptRounds = 5000
+
+// cryptSalt returns a random salt of the longest size sha512 crypt reads
+func cryptSalt() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	salt := make([]byte, len(random))
+	for i, b := range random {
+		//the alphabet has 64 characters, the low 6 bits pick one uniformly
+		salt[i] = cryptAlphabet[b & 0x3f]
+	}
+	return string(salt), nil
+}
+
+// sha512Crypt is the $6$ scheme of glibc, per "Unix crypt using SHA-256 and SHA-512" by Ulrich Drepper
+func sha512Crypt(password, salt string) string {
+	key := []byte(password)
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	saltBytes := []byte(salt)
+
+	alternate := sha512.New()
+	alternate.Write(key)
+	alternate.Write(saltBytes)
+	alternate.Write(key)
+	alternateSum := alternate.Sum(nil)
+
+	digest := sha512.New()
+	digest.Write(key)
+	digest.Write(saltBytes)
+	cnt := len(key)
+	for ; cnt > 64; cnt -= 64 {
+		digest.Write(alternateSum)
+	}
+	digest.Write(alternateSum[:cnt])
+	for cnt = len(key); cnt > 0; cnt >>= 1 {
+		if cnt & 1 != 0 {
+			digest.Write(alternateSum)
+		} else {
+			digest.Write(key)
+		}
+	}
+	digestSum := digest.Sum(nil)
+
+	keyDigest := sha512.New()
+	for i := 0; i < len(key); i++ {
+		keyDigest.Write(key)
+	}
+	keySequence := repeatDigest(keyDigest.Sum(nil), len(key))
+
+	saltDigest := sha512.New()
+	for i := 0; i < 16 + int(digestSum[0]); i++ {
+		saltDigest.Write(saltBytes)
+	}
+	saltSequence := repeatDigest(saltDigest.Sum(nil), len(saltBytes))
+
+	for i := 0; i < sha512CryptRounds; i++ {
+		round := sha512.New()
+		if i & 1 != 0 {
+			round.Write(keySequence)
+		} else {
+			round.Write(digestSum)
+		}
+		if i % 3 != 0 {
+			round.Write(saltSequence)
+		}
+		if i % 7 != 0 {
+			round.Write(keySequence)
+		}
+		if i & 1 != 0 {
+			round.Write(digestSum)
+		} else {
+			round.Write(keySequence)
+		}
+		digestSum = round.Sum(nil)
+	}
+
+	encoded := make([]byte, 0, 86)
+	for i := 0; i < 21; i++ {
+		encoded = appendCrypt64(encoded, digestSum[i], digestSum[i + 21], digestSum[i + 42], 4, i % 3)
+	}
+	encoded = appendCrypt64(encoded, 0, 0, digestSum[63], 2, 0)
+	return "$6$" + salt + "$" + string(encoded)
+}
+
+func repeatDigest(sum []byte, length int) []byte {
+	sequence := make([]byte, 0, length)
+	for len(sequence) + len(sum) <= length {
+		sequence = append(sequence, sum...)
+	}
+	return append(sequence, sum[:length - len(sequence)]...)
+}
+
+//the bytes of each group are rotated by the group index, the order of glibc
+func appendCrypt64(encoded []byte, first, second, third byte, n, rotation int) []byte {
+	group := []byte{first, second, third}
+	b2, b1, b0 := group[rotation], group[(rotation + 1) % 3], group[(rotation + 2) % 3]
+	w := uint(b2) << 16 | uint(b1) << 8 | uint(b0)
+	for ; n > 0; n-- {
+		encoded = append(encoded, cryptAlphabet[w & 0x3f])
+		w >>= 6
+	}
+	return encoded
+}
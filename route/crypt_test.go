@@ -0,0 +1,38 @@
+package route
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSha512Crypt(t *testing.T) {
+	//the test vectors of "Unix crypt using SHA-256 and SHA-512" with the default rounds
+	tests := []struct {
+		password string
+		salt     string
+		hash     string
+	}{
+		{"Hello world!", "saltstring", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"This is just a test", "toolongsaltstring", "$6$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+	}
+	for _, test := range tests {
+		if hash := sha512Crypt(test.password, test.salt); hash != test.hash {
+			t.Errorf("sha512 crypt of %s: got %s, expected %s", test.password, hash, test.hash)
+		}
+	}
+}
+
+func TestCryptSalt(t *testing.T) {
+	salt, err := cryptSalt()
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(salt) != 16 {
+		t.Errorf("salt %s has %d characters, expected 16", salt, len(salt))
+	}
+	for _, c := range salt {
+		if !strings.ContainsRune(cryptAlphabet, c) {
+			t.Errorf("salt %s has the character %c out of the crypt alphabet", salt, c)
+		}
+	}
+}
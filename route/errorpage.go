@@ -0,0 +1,80 @@
+package route
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+)
+
+// ErrorPage replaces the response of a status code, a url is fetched on provision and update
+type ErrorPage struct {
+	Html            string                          `json:"html,omitempty"`
+	Url             string                          `json:"url,omitempty"`
+}
+
+const ErrorPagesDir = "_errors"
+
+const MaxErrorPageSize = 64 * 1024
+
+var errorStatusPattern = regexp.MustCompile(`^[45][0-9][0-9]$`)
+
+//served with 503 when maintenance is on and no 503 page is set
+const defaultMaintenancePage = `<!DOCTYPE html>
+<html>
+<head><title>Under maintenance</title></head>
+<body><h1>Under maintenance</h1><p>The service is under maintenance, please try again later.</p></body>
+</html>
+`
+
+func ValidateErrorPages(pages map[string]ErrorPage) error {
+	for status, page := range pages {
+		if !errorStatusPattern.MatchString(status) {
+			return fmt.Errorf("error page status %s must be a 4xx or 5xx status code", status)
+		}
+		if (page.Html == "") == (page.Url == "") {
+			return fmt.Errorf("error page %s needs either html or url", status)
+		}
+		if len(page.Html) > MaxErrorPageSize {
+			return fmt.Errorf("error page %s exceeds %d bytes", status, MaxErrorPageSize)
+		}
+		if page.Url != "" {
+			u, err := url.Parse(page.Url)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("error page %s url %s must be an http or https url", status, page.Url)
+			}
+		}
+	}
+	return nil
+}
+
+// ErrorPageStatuses lists the status codes with an error page, maintenance always has a 503 page
+func (ns NginxService) ErrorPageStatuses() []string {
+	statuses := make([]string, 0)
+	for status := range ns.ErrorPages {
+		statuses = append(statuses, status)
+	}
+	if _, ok := ns.ErrorPages["503"]; ns.Maintenance && !ok {
+		statuses = append(statuses, "503")
+	}
+	sort.Strings(statuses)
+	return statuses
+}
+
+func (ns NginxService) ErrorPageHtml(status string) []byte {
+	if page, ok := ns.ErrorPages[status]; ok {
+		return []byte(page.Html)
+	}
+	return []byte(defaultMaintenancePage)
+}
+
+func (ns NginxService) ErrorPagesDir() string {
+	return ErrorPagesDir
+}
+
+func (ns NginxService) MaintenanceRetryAfter() int {
+	if ns.RetryAfter == 0 {
+		return 300
+	}
+	return ns.RetryAfter
+}
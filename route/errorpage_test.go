@@ -0,0 +1,58 @@
+package route
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateErrorPages(t *testing.T) {
+	tests := []struct {
+		name  string
+		pages map[string]ErrorPage
+		valid bool
+	}{
+		{"none", nil, true},
+		{"html", map[string]ErrorPage{"404": {Html: "<h1>Not found</h1>"}}, true},
+		{"url", map[string]ErrorPage{"503": {Url: "https://example.com/503.html"}}, true},
+		{"success status", map[string]ErrorPage{"200": {Html: "ok"}}, false},
+		{"status text", map[string]ErrorPage{"not_found": {Html: "missing"}}, false},
+		{"html and url", map[string]ErrorPage{"404": {Html: "missing", Url: "https://example.com/404.html"}}, false},
+		{"no html nor url", map[string]ErrorPage{"404": {}}, false},
+		{"html too large", map[string]ErrorPage{"500": {Html: strings.Repeat("a", MaxErrorPageSize+1)}}, false},
+		{"html of the maximum size", map[string]ErrorPage{"500": {Html: strings.Repeat("a", MaxErrorPageSize)}}, true},
+		{"file url", map[string]ErrorPage{"404": {Url: "file:///etc/passwd"}}, false},
+		{"url without host", map[string]ErrorPage{"404": {Url: "https:///404.html"}}, false},
+	}
+	for _, test := range tests {
+		err := ValidateErrorPages(test.pages)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestErrorPageStatuses(t *testing.T) {
+	pages := map[string]ErrorPage{"502": {Html: "bad gateway"}, "404": {Html: "not found"}}
+	tests := []struct {
+		name        string
+		pages       map[string]ErrorPage
+		maintenance bool
+		statuses    []string
+	}{
+		{"none", nil, false, []string{}},
+		{"pages", pages, false, []string{"404", "502"}},
+		{"maintenance", nil, true, []string{"503"}},
+		{"maintenance with pages", pages, true, []string{"404", "502", "503"}},
+		{"maintenance with its page", map[string]ErrorPage{"503": {Html: "later"}}, true, []string{"503"}},
+	}
+	for _, test := range tests {
+		ns := NginxService{ErrorPages: test.pages, Maintenance: test.maintenance}
+		if statuses := ns.ErrorPageStatuses(); !reflect.DeepEqual(statuses, test.statuses) {
+			t.Errorf("%s: got %v, expected %v", test.name, statuses, test.statuses)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package route
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Headers changes the proxied request and response headers, values may use nginx variables
+type Headers struct {
+	SetRequest      map[string]string               `json:"set_request,omitempty"`
+	RemoveRequest   []string                        `json:"remove_request,omitempty"`
+	SetResponse     map[string]string               `json:"set_response,omitempty"`
+	AddResponse     map[string]string               `json:"add_response,omitempty"`
+	RemoveResponse  []string                        `json:"remove_response,omitempty"`
+}
+
+var headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+//hop-by-hop and framing headers stay with nginx, only these and the x- headers can be changed
+var safeRequestHeaders = []string{
+	"authorization", "accept-language", "user-agent", "referer", "forwarded",
+}
+
+var safeResponseHeaders = []string{
+	"strict-transport-security", "content-security-policy", "content-security-policy-report-only",
+	"referrer-policy", "permissions-policy", "feature-policy", "cache-control", "expires", "pragma",
+	"vary", "link", "timing-allow-origin", "cross-origin-opener-policy", "cross-origin-embedder-policy",
+	"cross-origin-resource-policy",
+}
+
+func (h Headers) Validate() error {
+	for name, value := range h.SetRequest {
+		if err := validateHeader(name, value, safeRequestHeaders); err != nil {
+			return err
+		}
+	}
+	for _, name := range h.RemoveRequest {
+		if err := validateHeader(name, "", safeRequestHeaders); err != nil {
+			return err
+		}
+	}
+	for name, value := range h.SetResponse {
+		if err := validateHeader(name, value, safeResponseHeaders, "access-control-"); err != nil {
+			return err
+		}
+	}
+	for name, value := range h.AddResponse {
+		if err := validateHeader(name, value, safeResponseHeaders, "access-control-"); err != nil {
+			return err
+		}
+	}
+	for _, name := range h.RemoveResponse {
+		if err := validateHeader(name, "", safeResponseHeaders, "access-control-"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateHeader(name, value string, safeHeaders []string, safePrefixes ...string) error {
+	if !headerNamePattern.MatchString(name) {
+		return fmt.Errorf("header name %q is invalid", name)
+	}
+	if !safeValue(value) {
+		return fmt.Errorf("header %s value must not contain quotes, backslashes or control characters", name)
+	}
+	lower := strings.ToLower(name)
+	if strings.HasPrefix(lower, "x-") {
+		return nil
+	}
+	for _, prefix := range safePrefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return nil
+		}
+	}
+	for _, safe := range safeHeaders {
+		if lower == safe {
+			return nil
+		}
+	}
+	return fmt.Errorf("header %s can not be changed", name)
+}
+
+// safeValue tells whether the value can be rendered in a double quoted nginx string
+func safeValue(value string) bool {
+	if strings.ContainsAny(value, "\"\\") {
+		return false
+	}
+	for _, r := range value {
+		if r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
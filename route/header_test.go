@@ -0,0 +1,59 @@
+package route
+
+import "testing"
+
+func TestHeadersValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers Headers
+		valid   bool
+	}{
+		{"empty", Headers{}, true},
+		{"set request", Headers{SetRequest: map[string]string{"X-Forwarded-Host": "$host", "Accept-Language": "en"}}, true},
+		{"set hop-by-hop request", Headers{SetRequest: map[string]string{"Connection": "close"}}, false},
+		{"set host request", Headers{SetRequest: map[string]string{"Host": "example.com"}}, false},
+		{"remove request", Headers{RemoveRequest: []string{"Authorization"}}, true},
+		{"remove framing request", Headers{RemoveRequest: []string{"Content-Length"}}, false},
+		{"set response", Headers{SetResponse: map[string]string{"Strict-Transport-Security": "max-age=31536000"}}, true},
+		{"set cors response", Headers{SetResponse: map[string]string{"Access-Control-Allow-Origin": "*"}}, true},
+		{"add response", Headers{AddResponse: map[string]string{"X-Frame-Options": "DENY"}}, true},
+		{"add framing response", Headers{AddResponse: map[string]string{"Transfer-Encoding": "chunked"}}, false},
+		{"remove response", Headers{RemoveResponse: []string{"X-Powered-By"}}, true},
+		{"remove cookie response", Headers{RemoveResponse: []string{"Set-Cookie"}}, false},
+		{"cors prefix on request", Headers{SetRequest: map[string]string{"Access-Control-Request-Method": "GET"}}, false},
+		{"invalid name", Headers{SetRequest: map[string]string{"X Name": "a"}}, false},
+		{"value quote", Headers{SetResponse: map[string]string{"X-A": `a"b`}}, false},
+		{"value newline", Headers{AddResponse: map[string]string{"X-A": "a\nb"}}, false},
+	}
+	for _, test := range tests {
+		err := test.headers.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestSafeValue(t *testing.T) {
+	tests := []struct {
+		value string
+		safe  bool
+	}{
+		{"", true},
+		{"max-age=31536000; includeSubDomains", true},
+		{"$host$request_uri", true},
+		{"unicode é", true},
+		{`a"b`, false},
+		{`a\b`, false},
+		{"a\tb", false},
+		{"a\rb", false},
+		{"a\x7fb", false},
+	}
+	for _, test := range tests {
+		if safe := safeValue(test.value); safe != test.safe {
+			t.Errorf("safe value %q: got %t, expected %t", test.value, safe, test.safe)
+		}
+	}
+}
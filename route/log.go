@@ -0,0 +1,40 @@
+package route
+
+import (
+	"fmt"
+	"net/url"
+)
+
+const (
+	AccessLogCloudfoundry = "cloudfoundry"
+	AccessLogCombined     = "combined"
+	AccessLogJson         = "json"
+)
+
+func ValidateAccessLog(format string) error {
+	switch format {
+	case "", AccessLogCloudfoundry, AccessLogCombined, AccessLogJson:
+		return nil
+	}
+	return fmt.Errorf("access_log %s must be one of %s, %s or %s", format, AccessLogCloudfoundry, AccessLogCombined, AccessLogJson)
+}
+
+// ValidateSyslogDrainUrl accepts the drain schemes of loggregator
+func ValidateSyslogDrainUrl(drainUrl string) error {
+	u, err := url.Parse(drainUrl)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("syslog_drain_url %s is invalid", drainUrl)
+	}
+	switch u.Scheme {
+	case "syslog", "syslog-tls", "https":
+		return nil
+	}
+	return fmt.Errorf("syslog_drain_url %s must use syslog, syslog-tls or https", drainUrl)
+}
+
+func (ns NginxService) AccessLogFormat() string {
+	if ns.AccessLog == "" {
+		return AccessLogCloudfoundry
+	}
+	return ns.AccessLog
+}
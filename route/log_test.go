@@ -0,0 +1,51 @@
+package route
+
+import "testing"
+
+func TestValidateAccessLog(t *testing.T) {
+	tests := []struct {
+		format string
+		valid  bool
+	}{
+		{"", true},
+		{AccessLogCloudfoundry, true},
+		{AccessLogCombined, true},
+		{AccessLogJson, true},
+		{"main", false},
+		{"json escape=none", false},
+	}
+	for _, test := range tests {
+		err := ValidateAccessLog(test.format)
+		if test.valid && err != nil {
+			t.Errorf("access_log %q: unexpected error %s", test.format, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("access_log %q: expected an error", test.format)
+		}
+	}
+}
+
+func TestValidateSyslogDrainUrl(t *testing.T) {
+	tests := []struct {
+		drainUrl string
+		valid    bool
+	}{
+		{"syslog://logs.example.com:514", true},
+		{"syslog-tls://logs.example.com:6514", true},
+		{"https://logs.example.com/drain", true},
+		{"http://logs.example.com/drain", false},
+		{"tcp://logs.example.com:514", false},
+		{"syslog://", false},
+		{"logs.example.com:514", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		err := ValidateSyslogDrainUrl(test.drainUrl)
+		if test.valid && err != nil {
+			t.Errorf("syslog_drain_url %q: unexpected error %s", test.drainUrl, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("syslog_drain_url %q: expected an error", test.drainUrl)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package route
+
+import "fmt"
+
+// RoleMirror bindings get a copy of the requests of the service instance, nginx drops their responses
+const RoleMirror = "mirror"
+
+func (n Nginx) Mirror() bool {
+	return n.Role == RoleMirror
+}
+
+// ValidateRole checks the role of a binding, a mirror copies all requests unless a percent is set
+func (n Nginx) ValidateRole() error {
+	switch n.Role {
+	case "":
+		if n.MirrorPercent != 0 {
+			return fmt.Errorf("mirror_percent needs the %s role", RoleMirror)
+		}
+	case RoleMirror:
+		if n.MirrorPercent < 0 || n.MirrorPercent > 100 {
+			return fmt.Errorf("mirror_percent must be between 0 and 100, 0 mirrors all requests")
+		}
+		if n.Protocol == ProtocolGrpc {
+			return fmt.Errorf("grpc bindings can not be mirrors")
+		}
+	default:
+		return fmt.Errorf("role %s must be empty or %s", n.Role, RoleMirror)
+	}
+	return nil
+}
+
+func (ns NginxService) MirrorNginxs() []Nginx {
+	nginxs := make([]Nginx, 0)
+	for _, n := range ns.Nginxs {
+		if n.Mirror() {
+			nginxs = append(nginxs, n)
+		}
+	}
+	return nginxs
+}
+
+func (n Nginx) MirrorSampled() bool {
+	return n.MirrorPercent > 0 && n.MirrorPercent < 100
+}
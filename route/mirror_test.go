@@ -0,0 +1,48 @@
+package route
+
+import "testing"
+
+func TestValidateRole(t *testing.T) {
+	tests := []struct {
+		name  string
+		nginx Nginx
+		valid bool
+	}{
+		{"no role", Nginx{}, true},
+		{"percent without role", Nginx{MirrorPercent: 10}, false},
+		{"mirror", Nginx{Role: RoleMirror}, true},
+		{"mirror percent", Nginx{Role: RoleMirror, MirrorPercent: 10}, true},
+		{"mirror all", Nginx{Role: RoleMirror, MirrorPercent: 100}, true},
+		{"mirror negative percent", Nginx{Role: RoleMirror, MirrorPercent: -1}, false},
+		{"mirror over 100 percent", Nginx{Role: RoleMirror, MirrorPercent: 101}, false},
+		{"grpc mirror", Nginx{Role: RoleMirror, Protocol: ProtocolGrpc}, false},
+		{"websocket mirror", Nginx{Role: RoleMirror, Protocol: ProtocolWebsocket}, true},
+		{"unknown role", Nginx{Role: "canary"}, false},
+	}
+	for _, test := range tests {
+		err := test.nginx.ValidateRole()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestMirrorSampled(t *testing.T) {
+	tests := []struct {
+		percent int
+		sampled bool
+	}{
+		{0, false},
+		{1, true},
+		{99, true},
+		{100, false},
+	}
+	for _, test := range tests {
+		if sampled := (Nginx{Role: RoleMirror, MirrorPercent: test.percent}).MirrorSampled(); sampled != test.sampled {
+			t.Errorf("mirror percent %d: got %t, expected %t", test.percent, sampled, test.sampled)
+		}
+	}
+}
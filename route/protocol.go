@@ -0,0 +1,61 @@
+package route
+
+import "fmt"
+
+const (
+	ProtocolHttp      = "http"
+	ProtocolWebsocket = "websocket"
+	ProtocolGrpc      = "grpc"
+)
+
+// TcpAppPort is the nginx application port the tcp route is mapped to
+const TcpAppPort = 8081
+
+// TcpRoute serves the grpc bindings, the gorouter only speaks http/1.1. The platform picks the port
+type TcpRoute struct {
+	Domain          string                          `json:"domain,omitempty"`
+	Port            int                             `json:"port,omitempty"`
+}
+
+func ValidateProtocol(protocol string) error {
+	switch protocol {
+	case "", ProtocolHttp, ProtocolWebsocket, ProtocolGrpc:
+		return nil
+	}
+	return fmt.Errorf("protocol %s must be one of %s, %s or %s", protocol, ProtocolHttp, ProtocolWebsocket, ProtocolGrpc)
+}
+
+// HttpNginxs are the bindings balanced by the http upstream
+func (ns NginxService) HttpNginxs() []Nginx {
+	nginxs := make([]Nginx, 0)
+	for _, n := range ns.Nginxs {
+		if n.Protocol != ProtocolGrpc && !n.Mirror() {
+			nginxs = append(nginxs, n)
+		}
+	}
+	return nginxs
+}
+
+// GrpcNginxs are the bindings balanced by the grpc upstream of the tcp route
+func (ns NginxService) GrpcNginxs() []Nginx {
+	nginxs := make([]Nginx, 0)
+	for _, n := range ns.Nginxs {
+		if n.Protocol == ProtocolGrpc && !n.Mirror() {
+			nginxs = append(nginxs, n)
+		}
+	}
+	return nginxs
+}
+
+func (ns NginxService) HasWebsocket() bool {
+	for _, n := range ns.Nginxs {
+		if n.Protocol == ProtocolWebsocket {
+			return true
+		}
+	}
+	return false
+}
+
+func (ns NginxService) TcpPort() int {
+	return TcpAppPort
+}
@@ -0,0 +1,44 @@
+package route
+
+import "testing"
+
+func TestValidateProtocol(t *testing.T) {
+	tests := []struct {
+		protocol string
+		valid    bool
+	}{
+		{"", true},
+		{ProtocolHttp, true},
+		{ProtocolWebsocket, true},
+		{ProtocolGrpc, true},
+		{"tcp", false},
+		{"HTTP", false},
+	}
+	for _, test := range tests {
+		err := ValidateProtocol(test.protocol)
+		if test.valid && err != nil {
+			t.Errorf("protocol %q: unexpected error %s", test.protocol, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("protocol %q: expected an error", test.protocol)
+		}
+	}
+}
+
+func TestProtocolNginxs(t *testing.T) {
+	ns := NginxService{Nginxs: []Nginx{
+		{Name: "web", Protocol: ProtocolHttp},
+		{Name: "socket", Protocol: ProtocolWebsocket},
+		{Name: "rpc", Protocol: ProtocolGrpc},
+		{Name: "copy", Role: RoleMirror},
+	}}
+	if nginxs := ns.HttpNginxs(); len(nginxs) != 2 || nginxs[0].Name != "web" || nginxs[1].Name != "socket" {
+		t.Errorf("http nginxs %+v, expected web and socket", nginxs)
+	}
+	if nginxs := ns.GrpcNginxs(); len(nginxs) != 1 || nginxs[0].Name != "rpc" {
+		t.Errorf("grpc nginxs %+v, expected rpc", nginxs)
+	}
+	if !ns.HasWebsocket() {
+		t.Errorf("expected a websocket binding")
+	}
+}
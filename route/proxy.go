@@ -0,0 +1,98 @@
+package route
+
+import "fmt"
+
+// Proxy overrides the nginx proxy defaults, timeouts are in seconds and a zero value keeps the default
+type Proxy struct {
+	ConnectTimeout    int                             `json:"connect_timeout,omitempty"`
+	ReadTimeout       int                             `json:"read_timeout,omitempty"`
+	SendTimeout       int                             `json:"send_timeout,omitempty"`
+	Buffering         *bool                           `json:"buffering,omitempty"`
+	ClientMaxBodySize int                             `json:"client_max_body_size_mb,omitempty"`
+	Keepalive         int                             `json:"keepalive,omitempty"`
+	KeepaliveTimeout  int                             `json:"keepalive_timeout,omitempty"`
+}
+
+//the connections nginx keeps open to its own binding servers when the keepalive is not set
+const defaultKeepalive = 2000
+
+func (p Proxy) Validate() error {
+	if p.ConnectTimeout < 0 || p.ReadTimeout < 0 || p.SendTimeout < 0 || p.KeepaliveTimeout < 0 {
+		return fmt.Errorf("proxy timeouts must not be negative")
+	}
+	if p.ClientMaxBodySize < 0 {
+		return fmt.Errorf("proxy client_max_body_size_mb must not be negative")
+	}
+	if p.Keepalive < 0 {
+		return fmt.Errorf("proxy keepalive must not be negative")
+	}
+	//nginx can not wait for a connection longer than 75 seconds
+	if p.ConnectTimeout > 75 {
+		return fmt.Errorf("proxy connect_timeout must not exceed 75 seconds")
+	}
+	return nil
+}
+
+// ValidateBinding also refuses the settings of the upstream shared by all bindings
+func (p Proxy) ValidateBinding() error {
+	if p.Keepalive != 0 || p.KeepaliveTimeout != 0 {
+		return fmt.Errorf("proxy keepalive and keepalive_timeout are service instance settings")
+	}
+	return p.Validate()
+}
+
+func (p Proxy) BufferingState() string {
+	if p.Buffering == nil {
+		return ""
+	}
+	if *p.Buffering {
+		return "on"
+	}
+	return "off"
+}
+
+func (p Proxy) UpstreamKeepalive() int {
+	if p.Keepalive == 0 {
+		return defaultKeepalive
+	}
+	return p.Keepalive
+}
+
+// ProxyTimeouts keeps websocket connections open for an hour unless the timeouts are set
+func (ns NginxService) ProxyTimeouts() Proxy {
+	return longTimeouts(ns.Proxy, ns.HasWebsocket())
+}
+
+// BindingProxy fills the binding settings from the service instance, so the binding servers cut nothing it lets through
+func (ns NginxService) BindingProxy(n Nginx) Proxy {
+	p := n.Proxy
+	if p.ConnectTimeout == 0 {
+		p.ConnectTimeout = ns.Proxy.ConnectTimeout
+	}
+	if p.ReadTimeout == 0 {
+		p.ReadTimeout = ns.Proxy.ReadTimeout
+	}
+	if p.SendTimeout == 0 {
+		p.SendTimeout = ns.Proxy.SendTimeout
+	}
+	if p.Buffering == nil {
+		p.Buffering = ns.Proxy.Buffering
+	}
+	if p.ClientMaxBodySize == 0 {
+		p.ClientMaxBodySize = ns.Proxy.ClientMaxBodySize
+	}
+	return longTimeouts(p, n.Protocol == ProtocolWebsocket || n.Protocol == ProtocolGrpc)
+}
+
+func longTimeouts(p Proxy, long bool) Proxy {
+	if !long {
+		return p
+	}
+	if p.ReadTimeout == 0 {
+		p.ReadTimeout = 3600
+	}
+	if p.SendTimeout == 0 {
+		p.SendTimeout = 3600
+	}
+	return p
+}
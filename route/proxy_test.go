@@ -0,0 +1,51 @@
+package route
+
+import "testing"
+
+func TestProxyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxy   Proxy
+		valid   bool
+		binding bool
+	}{
+		{"defaults", Proxy{}, true, true},
+		{"timeouts", Proxy{ConnectTimeout: 75, ReadTimeout: 600, SendTimeout: 600}, true, true},
+		{"connect timeout over 75 seconds", Proxy{ConnectTimeout: 76}, false, false},
+		{"negative read timeout", Proxy{ReadTimeout: -1}, false, false},
+		{"negative body size", Proxy{ClientMaxBodySize: -1}, false, false},
+		{"body size", Proxy{ClientMaxBodySize: 100}, true, true},
+		{"keepalive", Proxy{Keepalive: 100, KeepaliveTimeout: 60}, true, false},
+		{"negative keepalive", Proxy{Keepalive: -1}, false, false},
+		{"negative keepalive timeout", Proxy{KeepaliveTimeout: -1}, false, false},
+	}
+	for _, test := range tests {
+		err := test.proxy.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+		err = test.proxy.ValidateBinding()
+		if test.binding && err != nil {
+			t.Errorf("%s: unexpected binding error %s", test.name, err)
+		}
+		if !test.binding && err == nil {
+			t.Errorf("%s: expected a binding error", test.name)
+		}
+	}
+}
+
+func TestBindingProxy(t *testing.T) {
+	off := false
+	ns := NginxService{Proxy: Proxy{ConnectTimeout: 5, ReadTimeout: 120, Buffering: &off, ClientMaxBodySize: 50}}
+	p := ns.BindingProxy(Nginx{Proxy: Proxy{ReadTimeout: 30}})
+	if p.ConnectTimeout != 5 || p.ReadTimeout != 30 || p.SendTimeout != 0 || p.BufferingState() != "off" || p.ClientMaxBodySize != 50 {
+		t.Errorf("http binding proxy %+v", p)
+	}
+	p = ns.BindingProxy(Nginx{Protocol: ProtocolWebsocket})
+	if p.ReadTimeout != 120 || p.SendTimeout != 3600 {
+		t.Errorf("websocket binding proxy timeouts %d %d, expected 120 3600", p.ReadTimeout, p.SendTimeout)
+	}
+}
@@ -0,0 +1,184 @@
+package route
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	RewriteHttps    = "https"
+	RewriteRedirect = "redirect"
+	RewriteRewrite  = "rewrite"
+)
+
+// RewriteRule is applied in order before the proxy locations, the first matching rule wins
+type RewriteRule struct {
+	Type            string                          `json:"type"`
+	Match           string                          `json:"match,omitempty"`
+	Target          string                          `json:"target,omitempty"`
+	Status          int                             `json:"status,omitempty"`
+}
+
+const maxRewriteMatch = 256
+
+//a redirect chain longer than this is taken for a loop
+const maxRedirects = 10
+
+var (
+	targetVariablePattern = regexp.MustCompile(`\$(\{[0-9]\}|[A-Za-z0-9_]*)`)
+	capturePattern        = regexp.MustCompile(`\$\{?([0-9])\}?`)
+)
+
+//the variables a target may use besides the captures of the match
+var targetVariables = map[string]bool{
+	"host": true, "request_uri": true, "uri": true, "args": true, "scheme": true,
+}
+
+func (r RewriteRule) Validate() error {
+	switch r.Type {
+	case RewriteHttps:
+		if r.Match != "" || r.Target != "" {
+			return fmt.Errorf("rewrite rule %s takes no match and target", r.Type)
+		}
+	case RewriteRedirect, RewriteRewrite:
+		if r.Match == "" || r.Target == "" {
+			return fmt.Errorf("rewrite rule %s needs a match and a target", r.Type)
+		}
+	default:
+		return fmt.Errorf("rewrite rule type %s must be one of %s, %s or %s", r.Type, RewriteHttps, RewriteRedirect, RewriteRewrite)
+	}
+	switch r.Status {
+	case 0, 301, 302, 303, 307, 308:
+		if r.Type == RewriteRewrite && r.Status != 0 {
+			return fmt.Errorf("rewrite rule %s takes no status", r.Type)
+		}
+	default:
+		return fmt.Errorf("rewrite rule status %d must be one of 301, 302, 303, 307 or 308", r.Status)
+	}
+	if r.Type == RewriteHttps {
+		return nil
+	}
+	//nginx keeps the backslashes of a quoted string but an escaped backslash
+	unescaped := strings.Replace(r.Match, "\\", "", -1)
+	if len(r.Match) > maxRewriteMatch || !safeValue(unescaped) || strings.Contains(r.Match, "\\\\") || strings.HasSuffix(r.Match, "\\") {
+		return fmt.Errorf("rewrite rule match %s must be at most %d characters without quotes, escaped backslashes or control characters", r.Match, maxRewriteMatch)
+	}
+	//the go syntax leaves out the backtracking constructs of pcre
+	match, err := regexp.Compile(r.Match)
+	if err != nil {
+		return fmt.Errorf("rewrite rule match %s is invalid: %s", r.Match, err)
+	}
+	if !safeValue(r.Target) || strings.ContainsAny(r.Target, " ") {
+		return fmt.Errorf("rewrite rule target %s must not contain quotes, backslashes, spaces or control characters", r.Target)
+	}
+	if r.Type == RewriteRewrite && !strings.HasPrefix(r.Target, "/") {
+		return fmt.Errorf("rewrite rule target %s must be a path", r.Target)
+	}
+	if !strings.HasPrefix(r.Target, "/") && !strings.HasPrefix(r.Target, "http://") && !strings.HasPrefix(r.Target, "https://") && !strings.HasPrefix(r.Target, "$scheme://") {
+		return fmt.Errorf("rewrite rule target %s must be a path or an http, https or $scheme url", r.Target)
+	}
+	for _, variable := range targetVariablePattern.FindAllStringSubmatch(r.Target, -1) {
+		name := strings.Trim(variable[1], "{}")
+		if len(name) == 1 && name[0] >= '0' && name[0] <= '9' {
+			if int(name[0] - '0') > match.NumSubexp() {
+				return fmt.Errorf("rewrite rule target %s uses $%s, the match has %d groups", r.Target, name, match.NumSubexp())
+			}
+			continue
+		}
+		if !targetVariables[name] {
+			return fmt.Errorf("rewrite rule target %s uses the unknown variable $%s", r.Target, name)
+		}
+	}
+	return nil
+}
+
+func (r RewriteRule) RedirectStatus() int {
+	if r.Status == 0 {
+		return 301
+	}
+	return r.Status
+}
+
+// ValidateRewrites follows the redirects back to the service instance and refuses the loops
+func (ns NginxService) ValidateRewrites() error {
+	for _, r := range ns.Rewrites {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, r := range ns.Rewrites {
+		if r.Type != RewriteRedirect {
+			continue
+		}
+		uri, local := ns.localUri(sampleTarget(r.Target))
+		visited := map[string]bool{}
+		for hops := 0; local; hops++ {
+			if visited[uri] || hops == maxRedirects {
+				return fmt.Errorf("rewrite rule redirect %s to %s loops", r.Match, r.Target)
+			}
+			visited[uri] = true
+			uri, local = ns.redirect(uri)
+		}
+	}
+	return nil
+}
+
+// redirect tells whether the rules send the uri back to the service instance
+func (ns NginxService) redirect(uri string) (string, bool) {
+	for _, r := range ns.Rewrites {
+		if r.Type == RewriteHttps {
+			continue
+		}
+		match := regexp.MustCompile(r.Match)
+		submatches := match.FindStringSubmatchIndex(uri)
+		if submatches == nil {
+			continue
+		}
+		if r.Type == RewriteRewrite {
+			return "", false
+		}
+		target := string(match.ExpandString(nil, expandTemplate(r.Target), uri, submatches))
+		return ns.localUri(sampleTarget(target))
+	}
+	return "", false
+}
+
+//the captures of a target become go template groups, the nginx variables are escaped to stay as they are
+func expandTemplate(target string) string {
+	return targetVariablePattern.ReplaceAllStringFunc(target, func(variable string) string {
+		if capturePattern.MatchString(variable) {
+			return capturePattern.ReplaceAllString(variable, "$${$1}")
+		}
+		return "$" + variable
+	})
+}
+
+func (ns NginxService) localUri(target string) (string, bool) {
+	if strings.HasPrefix(target, "/") {
+		return strings.SplitN(target, "?", 2)[0], true
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", false
+	}
+	for _, r := range ns.AllRoutes() {
+		if strings.EqualFold(u.Host, r.Host + "." + r.Domain) {
+			return u.Path, true
+		}
+	}
+	return "", false
+}
+
+//nginx variables of a target stand for the host and the uri of the request, and a sample word for the captures
+func sampleTarget(target string) string {
+	target = strings.Replace(target, "$scheme://$host", "", -1)
+	target = strings.Replace(target, "https://$host", "", -1)
+	target = strings.Replace(target, "http://$host", "", -1)
+	for _, variable := range []string{"$request_uri", "$uri"} {
+		target = strings.Replace(target, variable, "/sample", -1)
+	}
+	target = strings.Replace(target, "$args", "", -1)
+	return capturePattern.ReplaceAllString(target, "sample")
+}
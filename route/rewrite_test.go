@@ -0,0 +1,175 @@
+package route
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRewriteRuleValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  RewriteRule
+		valid bool
+	}{
+		{"https", RewriteRule{Type: RewriteHttps}, true},
+		{"https with status", RewriteRule{Type: RewriteHttps, Status: 308}, true},
+		{"https with match", RewriteRule{Type: RewriteHttps, Match: "^/a$"}, false},
+		{"unknown type", RewriteRule{Type: "proxy", Match: "^/a$", Target: "/b"}, false},
+		{"redirect without target", RewriteRule{Type: RewriteRedirect, Match: "^/a$"}, false},
+		{"rewrite without match", RewriteRule{Type: RewriteRewrite, Target: "/b"}, false},
+		{"redirect status", RewriteRule{Type: RewriteRedirect, Match: "^/a$", Target: "/b", Status: 302}, true},
+		{"redirect unknown status", RewriteRule{Type: RewriteRedirect, Match: "^/a$", Target: "/b", Status: 404}, false},
+		{"rewrite with status", RewriteRule{Type: RewriteRewrite, Match: "^/a$", Target: "/b", Status: 301}, false},
+
+		{"match escaped dot", RewriteRule{Type: RewriteRedirect, Match: `^/a\.html$`, Target: "/b"}, true},
+		{"match quote", RewriteRule{Type: RewriteRedirect, Match: `^/a"$`, Target: "/b"}, false},
+		{"match escaped quote", RewriteRule{Type: RewriteRedirect, Match: `^/a\"$`, Target: "/b"}, false},
+		{"match escaped backslash", RewriteRule{Type: RewriteRedirect, Match: `^/a\\b$`, Target: "/b"}, false},
+		{"match trailing backslash", RewriteRule{Type: RewriteRedirect, Match: `^/a\`, Target: "/b"}, false},
+		{"match newline", RewriteRule{Type: RewriteRedirect, Match: "^/a\n$", Target: "/b"}, false},
+		{"match delete", RewriteRule{Type: RewriteRedirect, Match: "^/a\x7f$", Target: "/b"}, false},
+		{"match too long", RewriteRule{Type: RewriteRedirect, Match: "^/" + strings.Repeat("a", maxRewriteMatch), Target: "/b"}, false},
+		{"match invalid", RewriteRule{Type: RewriteRedirect, Match: "^/(a", Target: "/b"}, false},
+		{"match backtracking", RewriteRule{Type: RewriteRedirect, Match: `^/(a)\1$`, Target: "/b"}, false},
+
+		{"target quote", RewriteRule{Type: RewriteRedirect, Match: "^/a$", Target: `/b"`}, false},
+		{"target backslash", RewriteRule{Type: RewriteRedirect, Match: "^/a$", Target: `/b\c`}, false},
+		{"target space", RewriteRule{Type: RewriteRedirect, Match: "^/a$", Target: "/b c"}, false},
+		{"target control character", RewriteRule{Type: RewriteRedirect, Match: "^/a$", Target: "/b\tc"}, false},
+		{"target url", RewriteRule{Type: RewriteRedirect, Match: "^/a$", Target: "https://example.com/b"}, true},
+		{"target scheme url", RewriteRule{Type: RewriteRedirect, Match: "^/a$", Target: "$scheme://example.com/b"}, true},
+		{"target other scheme", RewriteRule{Type: RewriteRedirect, Match: "^/a$", Target: "ftp://example.com/b"}, false},
+		{"rewrite target url", RewriteRule{Type: RewriteRewrite, Match: "^/a$", Target: "https://example.com/b"}, false},
+
+		{"capture in bounds", RewriteRule{Type: RewriteRedirect, Match: "^/old/(.*)$", Target: "/new/$1"}, true},
+		{"capture braces in bounds", RewriteRule{Type: RewriteRedirect, Match: "^/(a)/(b)$", Target: "/${2}x/${1}"}, true},
+		{"capture whole match", RewriteRule{Type: RewriteRedirect, Match: "^/a$", Target: "/b$0"}, true},
+		{"capture out of bounds", RewriteRule{Type: RewriteRedirect, Match: "^/old/(.*)$", Target: "/new/$2"}, false},
+		{"capture braces out of bounds", RewriteRule{Type: RewriteRewrite, Match: "^/a$", Target: "/b/${1}"}, false},
+		{"capture non capturing group", RewriteRule{Type: RewriteRedirect, Match: "^/(?:a)$", Target: "/b/$1"}, false},
+		{"known variables", RewriteRule{Type: RewriteRedirect, Match: "^/a$", Target: "$scheme://$host/b?$args"}, true},
+		{"unknown variable", RewriteRule{Type: RewriteRedirect, Match: "^/a$", Target: "/b/$remote_addr"}, false},
+	}
+	for _, test := range tests {
+		err := test.rule.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestRedirectStatus(t *testing.T) {
+	if status := (RewriteRule{Type: RewriteRedirect}).RedirectStatus(); status != 301 {
+		t.Errorf("default status %d, expected 301", status)
+	}
+	if status := (RewriteRule{Type: RewriteRedirect, Status: 307}).RedirectStatus(); status != 307 {
+		t.Errorf("status %d, expected 307", status)
+	}
+}
+
+func TestValidateRewrites(t *testing.T) {
+	tests := []struct {
+		name     string
+		rewrites []RewriteRule
+		valid    bool
+	}{
+		{"no rules", nil, true},
+		{"invalid rule", []RewriteRule{{Type: RewriteRedirect, Match: `^/a"$`, Target: "/b"}}, false},
+		{"https", []RewriteRule{{Type: RewriteHttps}, {Type: RewriteRedirect, Match: "^/a$", Target: "/b"}}, true},
+		{"redirect", []RewriteRule{{Type: RewriteRedirect, Match: "^/old/(.*)$", Target: "/new/$1"}}, true},
+		{"chain", []RewriteRule{
+			{Type: RewriteRedirect, Match: "^/a$", Target: "/b"},
+			{Type: RewriteRedirect, Match: "^/b$", Target: "/c"},
+		}, true},
+		{"chain ended by a rewrite", []RewriteRule{
+			{Type: RewriteRewrite, Match: "^/b$", Target: "/a"},
+			{Type: RewriteRedirect, Match: "^/a$", Target: "/b"},
+		}, true},
+		{"other host", []RewriteRule{{Type: RewriteRedirect, Match: "^/(.*)$", Target: "https://other.example.com/$1"}}, true},
+		{"request uri on another path", []RewriteRule{{Type: RewriteRedirect, Match: "^/a$", Target: "https://$host$request_uri"}}, true},
+
+		{"self", []RewriteRule{{Type: RewriteRedirect, Match: "^/a$", Target: "/a"}}, false},
+		{"two rules", []RewriteRule{
+			{Type: RewriteRedirect, Match: "^/a$", Target: "/b"},
+			{Type: RewriteRedirect, Match: "^/b$", Target: "/a"},
+		}, false},
+		{"query string", []RewriteRule{{Type: RewriteRedirect, Match: "^/a$", Target: "/a?b=1"}}, false},
+		{"capture", []RewriteRule{{Type: RewriteRedirect, Match: "^/(.*)$", Target: "/$1"}}, false},
+		{"own host", []RewriteRule{{Type: RewriteRedirect, Match: "^/(.*)$", Target: "https://shop.example.com/$1"}}, false},
+		{"own host case", []RewriteRule{{Type: RewriteRedirect, Match: "^/(.*)$", Target: "https://SHOP.example.com/$1"}}, false},
+		{"other route of the instance", []RewriteRule{{Type: RewriteRedirect, Match: "^/(.*)$", Target: "https://www.example.org/$1"}}, false},
+		{"request uri", []RewriteRule{{Type: RewriteRedirect, Match: ".*", Target: "$scheme://$host$request_uri"}}, false},
+		{"growing uri", []RewriteRule{{Type: RewriteRedirect, Match: "^/a(.*)$", Target: "/aa$1"}}, false},
+	}
+	for _, test := range tests {
+		ns := NginxService{
+			Host:     "shop",
+			Domain:   "example.com",
+			Routes:   []Route{{Host: "www", Domain: "example.org"}},
+			Rewrites: test.rewrites,
+		}
+		err := ns.ValidateRewrites()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	ns := NginxService{
+		Host:   "shop",
+		Domain: "example.com",
+		Rewrites: []RewriteRule{
+			{Type: RewriteHttps},
+			{Type: RewriteRewrite, Match: "^/api/(.*)$", Target: "/v2/$1"},
+			{Type: RewriteRedirect, Match: "^/old/(.*)/(.*)$", Target: "/new/${2}/$1?from=old"},
+			{Type: RewriteRedirect, Match: "^/shop/(.*)$", Target: "https://shop.example.com/$1"},
+			{Type: RewriteRedirect, Match: "^/away/(.*)$", Target: "https://other.example.com/$1"},
+			{Type: RewriteRedirect, Match: "^/host/(.*)$", Target: "$scheme://$host/${1}?$args"},
+		},
+	}
+	tests := []struct {
+		uri    string
+		target string
+		local  bool
+	}{
+		{"/old/a/b", "/new/b/a", true},
+		{"/shop/cart", "/cart", true},
+		{"/away/cart", "", false},
+		{"/host/cart", "/cart", true},
+		{"/api/users", "", false},
+		{"/unmatched", "", false},
+	}
+	for _, test := range tests {
+		target, local := ns.redirect(test.uri)
+		if target != test.target || local != test.local {
+			t.Errorf("redirect %s: got %q %t, expected %q %t", test.uri, target, local, test.target, test.local)
+		}
+	}
+}
+
+func TestSampleTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		sample string
+	}{
+		{"/new/path", "/new/path"},
+		{"/new/$1", "/new/sample"},
+		{"/new/${1}/${2}", "/new/sample/sample"},
+		{"$scheme://$host$request_uri", "/sample"},
+		{"https://$host$uri?$args", "/sample?"},
+		{"http://$host/a", "/a"},
+		{"https://other.example.com/$1", "https://other.example.com/sample"},
+	}
+	for _, test := range tests {
+		if sample := sampleTarget(test.target); sample != test.sample {
+			t.Errorf("sample target %s: got %s, expected %s", test.target, sample, test.sample)
+		}
+	}
+}
@@ -2,8 +2,11 @@ package route
 
 import (
 	"text/template"
+	"io"
 	"io/ioutil"
 	"os"
+	"fmt"
+	"strings"
 )
 
 type NginxService struct {
@@ -11,7 +14,27 @@ type NginxService struct {
 	Host            string                          `json:"host"`
 	Domain          string                          `json:"domain"`
 	SessionSticky   bool                            `json:"enable_session_sticky"`
+	Sticky          Stickiness                      `json:"sticky"`
+	Routes          []Route                         `json:"routes,omitempty"`
+	Headers         Headers                         `json:"headers"`
+	Cache           Cache                           `json:"cache"`
+	Access          Access                          `json:"access"`
+	TcpRoute        *TcpRoute                       `json:"tcp_route,omitempty"`
+	Proxy           Proxy                           `json:"proxy"`
+	ErrorPages      map[string]ErrorPage            `json:"error_pages,omitempty"`
+	Maintenance     bool                            `json:"maintenance,omitempty"`
+	RetryAfter      int                             `json:"retry_after,omitempty"`
+	Rewrites        []RewriteRule                   `json:"rewrites,omitempty"`
+	AccessLog       string                          `json:"access_log,omitempty"`
+	SyslogDrainUrl  string                          `json:"syslog_drain_url,omitempty"`
+	StatusPath      string                          `json:"status_path,omitempty"`
+	//a rotated buildpack wins until the plan buildpack changes from RotatedPlanBuildpack
+	Stack           string                          `json:"stack,omitempty"`
+	Buildpack       string                          `json:"buildpack,omitempty"`
+	RotatedPlanBuildpack string                     `json:"rotated_plan_buildpack,omitempty"`
 	Nginxs		[]Nginx				`json:"nginxs"`
+	Resolver        string                          `json:"-"`
+	TrustedProxies  []string                        `json:"-"`
 }
 
 type Nginx struct {
@@ -19,9 +42,66 @@ type Nginx struct {
 	Url		string				`json:"url"`
 	Weight          int				`json:"weight"`
 	Port            int				`json:"port"`
+	BackendPort     int				`json:"backend_port,omitempty"`
+	Internal        bool				`json:"internal,omitempty"`
+	AppGuid         string				`json:"app_guid,omitempty"`
+	Headers         Headers				`json:"headers"`
+	Protocol        string				`json:"protocol,omitempty"`
+	Proxy           Proxy				`json:"proxy"`
+	Role            string				`json:"role,omitempty"`
+	MirrorPercent   int				`json:"mirror_percent,omitempty"`
+}
+
+// Route is an additional route, the host and domain of the service are always the first one
+type Route struct {
+	Host            string                          `json:"host"`
+	Domain          string                          `json:"domain"`
+	Path            string                          `json:"path,omitempty"`
+}
+
+func (r Route) Validate() error {
+	if r.Host == "" || r.Domain == "" {
+		return fmt.Errorf("route %s.%s%s must have a host and a domain", r.Host, r.Domain, r.Path)
+	}
+	if r.Path != "" && (!strings.HasPrefix(r.Path, "/") || r.Path == "/") {
+		return fmt.Errorf("route path %s must start with / and must not be /", r.Path)
+	}
+	return nil
+}
+
+func (r Route) Equal(other Route) bool {
+	return strings.EqualFold(r.Host, other.Host) && strings.EqualFold(r.Domain, other.Domain) && r.Path == other.Path
+}
+
+// AllRoutes returns the host and domain route followed by the additional routes, without duplicates
+func (ns NginxService) AllRoutes() []Route {
+	routes := []Route{{Host: ns.Host, Domain: ns.Domain}}
+	for _, r := range ns.Routes {
+		duplicate := false
+		for _, existing := range routes {
+			if existing.Equal(r) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			routes = append(routes, r)
+		}
+	}
+	return routes
 }
 
 func ParseNginxTemplate(nginxTemplFile string, nginsService NginxService, destinationFile string) (error){
+	desfile, err := os.Create(destinationFile)
+	if err != nil {
+		return err
+	}
+	defer desfile.Close()
+	return RenderNginxTemplate(nginxTemplFile, nginsService, desfile)
+}
+
+// RenderNginxTemplate writes the nginx config of the service instance to w
+func RenderNginxTemplate(nginxTemplFile string, nginsService NginxService, w io.Writer) (error){
 	input, ioErr := ioutil.ReadFile(nginxTemplFile)
 	if ioErr != nil {
 		return ioErr
@@ -30,10 +110,5 @@ func ParseNginxTemplate(nginxTemplFile string, nginsService NginxService, destin
 	if err != nil {
 		return err
 	}
-	desfile, err := os.Create(destinationFile)
-	if err != nil {
-		return err
-	}
-	defer desfile.Close()
-	return nginxTemplate.Execute(desfile, nginsService)
+	return nginxTemplate.Execute(w, nginsService)
 }
\ No newline at end of file
@@ -0,0 +1,139 @@
+package route
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRouteValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		route Route
+		valid bool
+	}{
+		{"host and domain", Route{Host: "www", Domain: "example.com"}, true},
+		{"path", Route{Host: "www", Domain: "example.com", Path: "/shop"}, true},
+		{"no host", Route{Domain: "example.com"}, false},
+		{"no domain", Route{Host: "www"}, false},
+		{"root path", Route{Host: "www", Domain: "example.com", Path: "/"}, false},
+		{"relative path", Route{Host: "www", Domain: "example.com", Path: "shop"}, false},
+	}
+	for _, test := range tests {
+		err := test.route.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestAllRoutes(t *testing.T) {
+	ns := NginxService{
+		Host:   "shop",
+		Domain: "example.com",
+		Routes: []Route{{Host: "SHOP", Domain: "example.com"}, {Host: "www", Domain: "example.org"}, {Host: "shop", Domain: "example.com", Path: "/a"}},
+	}
+	expected := []Route{{Host: "shop", Domain: "example.com"}, {Host: "www", Domain: "example.org"}, {Host: "shop", Domain: "example.com", Path: "/a"}}
+	routes := ns.AllRoutes()
+	if len(routes) != len(expected) {
+		t.Fatalf("got %+v, expected %+v", routes, expected)
+	}
+	for i, r := range routes {
+		if r != expected[i] {
+			t.Errorf("route %d: got %+v, expected %+v", i, r, expected[i])
+		}
+	}
+}
+
+func renderNginxTemplate(t *testing.T, ns NginxService) string {
+	var buf bytes.Buffer
+	if err := RenderNginxTemplate("../static/nginx.conf.templ", ns, &buf); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	return buf.String()
+}
+
+func expectDirectives(t *testing.T, name, conf string, directives []string) {
+	for _, directive := range directives {
+		if !strings.Contains(conf, directive) {
+			t.Errorf("%s: the nginx config misses %q", name, directive)
+		}
+	}
+}
+
+func TestRenderNginxTemplate(t *testing.T) {
+	ns := NginxService{
+		ServiceId:  "instance",
+		Host:       "shop",
+		Domain:     "example.com",
+		Sticky:     Stickiness{Strategy: StickyCookieHash, Cookie: "session"},
+		Headers:    Headers{AddResponse: map[string]string{"X-Frame-Options": "DENY"}},
+		Cache:      Cache{MaxSize: 100, Rules: []CacheRule{{Path: "/static", Valid: map[string]string{"200": "10m"}}}},
+		Access:     Access{Allow: []string{"10.0.0.0/8"}, BasicAuth: []BasicAuthUser{{Username: "alice", Hash: validCryptHash}}},
+		TcpRoute:   &TcpRoute{Domain: "tcp.example.com", Port: 1024},
+		Proxy:      Proxy{ClientMaxBodySize: 20},
+		ErrorPages: map[string]ErrorPage{"404": {Html: "missing"}},
+		Rewrites: []RewriteRule{
+			{Type: RewriteHttps},
+			{Type: RewriteRedirect, Match: "^/old/(.*)$", Target: "/new/$1"},
+			{Type: RewriteRewrite, Match: "^/api/(.*)$", Target: "/v2/$1"},
+		},
+		AccessLog: AccessLogJson,
+		Nginxs: []Nginx{
+			{Name: "web", Url: "web.example.com", Weight: 1, Port: 8090},
+			{Name: "socket", Url: "socket.apps.internal", Weight: 1, Port: 8091, BackendPort: 8080, Internal: true, Protocol: ProtocolWebsocket},
+			{Name: "rpc", Url: "rpc.apps.internal", Weight: 1, Port: 8092, BackendPort: 9000, Protocol: ProtocolGrpc},
+			{Name: "copy", Url: "copy.example.com", Port: 8093, Role: RoleMirror, MirrorPercent: 10},
+		},
+	}
+	expectDirectives(t, "service", renderNginxTemplate(t, ns), []string{
+		"access_log /dev/stdout json;",
+		`"127.0.0.1:8090" "web";`,
+		"proxy_set_header Upgrade $http_upgrade;",
+		"proxy_set_header Connection $connection_upgrade;",
+		"set $backend socket.apps.internal:8080;",
+		"listen 8092 http2;",
+		"grpc_pass        grpc://rpc.apps.internal:9000;",
+		"hash $cookie_session consistent;",
+		"proxy_cache_path /home/vcap/tmp/nginx-cache levels=1:2 keys_zone=cache_instance:10m max_size=100m inactive=60m use_temp_path=off;",
+		"location /static {",
+		"proxy_cache cache_instance;",
+		"proxy_cache_valid 200 10m;",
+		"allow 10.0.0.0/8;",
+		"deny all;",
+		`auth_basic "Restricted";`,
+		"auth_basic_user_file /home/vcap/app/",
+		"error_page 404 /_errors/404.html;",
+		"proxy_intercept_errors on;",
+		"return 301 https://$host$request_uri;",
+		`if ($uri ~ "^/old/(.*)$") {`,
+		`return 301 "/new/$1";`,
+		`rewrite "^/api/(.*)$" "/v2/$1" last;`,
+		`add_header X-Frame-Options "DENY" always;`,
+		"client_max_body_size 20m;",
+		`split_clients "${request_id}" $mirror_8093 {`,
+		"mirror /_mirror/8093;",
+		"location = /_mirror/8093 {",
+		"upstream instance_grpc {",
+		"listen 8081 http2;",
+		"grpc_pass grpc://instance_grpc;",
+	})
+
+	ns.Maintenance = true
+	ns.RetryAfter = 120
+	ns.Nginxs = ns.Nginxs[:1]
+	conf := renderNginxTemplate(t, ns)
+	expectDirectives(t, "maintenance", conf, []string{
+		"error_page 503 /_errors/503.html;",
+		"set $maintenance_retry_after 120;",
+		"add_header Retry-After $maintenance_retry_after always;",
+		"listen 8081;",
+		"add_header Retry-After 120 always;",
+	})
+	if strings.Contains(conf, "proxy_cache cache_instance;") {
+		t.Errorf("maintenance: the nginx config still proxies to the cache")
+	}
+}
@@ -0,0 +1,45 @@
+package route
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// StatsLogFile has a line per request with the binding port, the status and the upstream response time
+const StatsLogFile = "/home/vcap/tmp/nginx-stats.log"
+
+// StatsLogMaxSize in megabytes, nginx appends so the truncation needs no reopen
+const StatsLogMaxSize = 16
+
+// ProfileFile is run by cloud foundry before the start command of the nginx application, whatever its buildpack
+const ProfileFile = ".profile"
+
+//checks the size of the stats log every 10 seconds in the background of the nginx application
+const statsProfile = `# the stats log is read by the service broker, truncate it past %dMB
+(
+  while true; do
+    sleep 10
+    if [ "$(stat -c %%s %s 2>/dev/null || echo 0)" -gt %d ]; then
+      : > %s
+    fi
+  done
+) &
+`
+
+// NewStatusPath returns the secret path of the status locations, only the broker knows it
+func NewStatusPath() (string, error) {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return "_status-" + hex.EncodeToString(secret), nil
+}
+
+func (ns NginxService) StatsLogFile() string {
+	return StatsLogFile
+}
+
+func (ns NginxService) StatsProfile() []byte {
+	return []byte(fmt.Sprintf(statsProfile, StatsLogMaxSize, StatsLogFile, StatsLogMaxSize * 1024 * 1024, StatsLogFile))
+}
@@ -0,0 +1,64 @@
+package route
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	StickyIPHash        = "ip_hash"
+	StickyCookieHash    = "cookie_hash"
+	StickyRoutingCookie = "routing_cookie"
+	StickyModule        = "module"
+)
+
+// Stickiness keeps a client on the same binding, the module strategy needs a buildpack shipping the sticky module
+type Stickiness struct {
+	Strategy        string                          `json:"strategy"`
+	Cookie          string                          `json:"cookie,omitempty"`
+	MaxAge          int                             `json:"max_age,omitempty"`
+}
+
+//nginx only exposes cookies with these names as $cookie_ variables
+var cookieNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+func (s Stickiness) Validate() error {
+	switch s.Strategy {
+	case "", StickyIPHash, StickyRoutingCookie, StickyModule:
+	case StickyCookieHash:
+		if s.Cookie == "" {
+			return fmt.Errorf("sticky strategy %s needs a cookie", s.Strategy)
+		}
+	default:
+		return fmt.Errorf("sticky strategy %s must be one of %s, %s, %s or %s", s.Strategy, StickyIPHash, StickyCookieHash, StickyRoutingCookie, StickyModule)
+	}
+	if s.Cookie != "" && !cookieNamePattern.MatchString(s.Cookie) {
+		return fmt.Errorf("sticky cookie %s must use letters, digits or _", s.Cookie)
+	}
+	if s.MaxAge < 0 {
+		return fmt.Errorf("sticky max_age must not be negative")
+	}
+	return nil
+}
+
+// StickyStrategy falls back to the routing cookie for instances created with enable_session_sticky
+func (ns NginxService) StickyStrategy() string {
+	if ns.Sticky.Strategy == "" && ns.SessionSticky {
+		return StickyRoutingCookie
+	}
+	return ns.Sticky.Strategy
+}
+
+func (ns NginxService) StickyCookie() string {
+	if ns.Sticky.Cookie == "" {
+		return "nginx_route"
+	}
+	return ns.Sticky.Cookie
+}
+
+func (ns NginxService) StickyMaxAge() int {
+	if ns.Sticky.MaxAge == 0 {
+		return 3600
+	}
+	return ns.Sticky.MaxAge
+}
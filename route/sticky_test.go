@@ -0,0 +1,45 @@
+package route
+
+import "testing"
+
+func TestStickinessValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		sticky Stickiness
+		valid  bool
+	}{
+		{"none", Stickiness{}, true},
+		{"ip hash", Stickiness{Strategy: StickyIPHash}, true},
+		{"cookie hash", Stickiness{Strategy: StickyCookieHash, Cookie: "JSESSIONID"}, true},
+		{"cookie hash without cookie", Stickiness{Strategy: StickyCookieHash}, false},
+		{"routing cookie", Stickiness{Strategy: StickyRoutingCookie, Cookie: "route", MaxAge: 60}, true},
+		{"module", Stickiness{Strategy: StickyModule}, true},
+		{"unknown strategy", Stickiness{Strategy: "least_conn"}, false},
+		{"cookie dash", Stickiness{Strategy: StickyRoutingCookie, Cookie: "my-route"}, false},
+		{"cookie semicolon", Stickiness{Strategy: StickyCookieHash, Cookie: "a;b"}, false},
+		{"negative max age", Stickiness{Strategy: StickyRoutingCookie, MaxAge: -1}, false},
+	}
+	for _, test := range tests {
+		err := test.sticky.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestStickyDefaults(t *testing.T) {
+	ns := NginxService{SessionSticky: true}
+	if strategy := ns.StickyStrategy(); strategy != StickyRoutingCookie {
+		t.Errorf("enable_session_sticky strategy %s, expected %s", strategy, StickyRoutingCookie)
+	}
+	if cookie, maxAge := ns.StickyCookie(), ns.StickyMaxAge(); cookie != "nginx_route" || maxAge != 3600 {
+		t.Errorf("default cookie %s max age %d, expected nginx_route 3600", cookie, maxAge)
+	}
+	ns.Sticky = Stickiness{Strategy: StickyIPHash}
+	if strategy := ns.StickyStrategy(); strategy != StickyIPHash {
+		t.Errorf("strategy %s, expected %s", strategy, StickyIPHash)
+	}
+}